@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
+)
+
+func runAdmin(args []string) error {
+	var gateway gatewayFlags
+	flags := flag.NewFlagSet("admin", flag.ExitOnError)
+	gateway.register(flags)
+	snapshotFile := flags.String("snapshot-file", "", "where to write the snapshot, defaults to snapshot-<serial>.json")
+	resetKey := flags.String("reset-key", "", "reset key for factory-reset, hex encoded")
+	macAddress := flags.String("mac", "", "new MAC address for set-device-settings, hex encoded")
+	serialNumber := flags.String("serial", "", "new serial number for set-device-settings")
+	address := flags.String("uuid", "", "new uuid for set-address, hex encoded")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: admin [flags] <snapshot|factory-reset|set-device-settings|set-address>\n\nflags:\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected exactly one admin operation")
+	}
+	operation := flags.Arg(0)
+
+	// validate all input before we touch the gateway
+	var operationFunc func(session *comfoconnect.Session, confirm comfoconnect.ConfirmFunc) (comfoconnect.DeviceSnapshot, error)
+	switch operation {
+	case "snapshot":
+	case "factory-reset":
+		key, err := hex.DecodeString(*resetKey)
+		if err != nil || len(key) == 0 {
+			return errors.New("factory-reset needs a hex encoded -reset-key")
+		}
+		operationFunc = func(session *comfoconnect.Session, confirm comfoconnect.ConfirmFunc) (comfoconnect.DeviceSnapshot, error) {
+			return session.FactoryReset(key, confirm)
+		}
+	case "set-device-settings":
+		mac, err := hex.DecodeString(*macAddress)
+		if err != nil || len(mac) != 6 {
+			return errors.New("set-device-settings needs a hex encoded 6 byte -mac")
+		}
+		if *serialNumber == "" {
+			return errors.New("set-device-settings needs a -serial")
+		}
+		operationFunc = func(session *comfoconnect.Session, confirm comfoconnect.ConfirmFunc) (comfoconnect.DeviceSnapshot, error) {
+			return session.SetDeviceSettings(mac, *serialNumber, confirm)
+		}
+	case "set-address":
+		uuid, err := hex.DecodeString(*address)
+		if err != nil || len(uuid) != 16 {
+			return errors.New("set-address needs a hex encoded 16 byte -uuid")
+		}
+		operationFunc = func(session *comfoconnect.Session, confirm comfoconnect.ConfirmFunc) (comfoconnect.DeviceSnapshot, error) {
+			return session.SetAddress(uuid, confirm)
+		}
+	default:
+		flags.Usage()
+		return errors.New(fmt.Sprintf("unknown admin operation: %s", operation))
+	}
+
+	session, closeSession, err := gateway.connect()
+	if err != nil {
+		return errors.Wrap(err, "connecting to gateway")
+	}
+	defer closeSession()
+
+	if operationFunc == nil {
+		snapshot, err := session.Snapshot()
+		if err != nil {
+			return errors.Wrap(err, "taking snapshot")
+		}
+		return writeSnapshot(snapshot, *snapshotFile)
+	}
+
+	// the operation takes the snapshot, we keep it and ask for the serial number before it changes anything
+	_, err = operationFunc(session, func(snapshot comfoconnect.DeviceSnapshot) (string, error) {
+		err := writeSnapshot(snapshot, *snapshotFile)
+		if err != nil {
+			return "", err
+		}
+		fmt.Printf("\nabout to run %s on gateway %s (%s)\ntype the serial number of the gateway to confirm: ", operation, snapshot.SerialNumber, gateway.ip)
+		confirmSerial, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		return strings.TrimSpace(confirmSerial), nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s done\n", operation)
+	return nil
+}
+
+// writeSnapshot prints the snapshot and writes it to `path`, or to snapshot-<serial>.json when it's empty
+func writeSnapshot(snapshot comfoconnect.DeviceSnapshot, path string) error {
+	b, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encoding snapshot")
+	}
+	if path == "" {
+		path = fmt.Sprintf("snapshot-%s.json", snapshot.SerialNumber)
+	}
+	err = ioutil.WriteFile(path, b, 0600)
+	if err != nil {
+		return errors.Wrap(err, "writing snapshot")
+	}
+	fmt.Printf("%s\nsnapshot written to %s\n", b, path)
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
+)
+
+type command struct {
+	description string
+	run         func(args []string) error
+}
+
+var commands = map[string]command{
+	"admin":    {"snapshot and recommission the gateway", runAdmin},
+	"debug":    {"send a DebugRequest to the gateway", runDebug},
+	"discover": {"find gateways on the local network", runDiscover},
+}
+
+func main() {
+	logrus.SetLevel(logrus.WarnLevel)
+	customFormatter := new(logrus.TextFormatter)
+	customFormatter.TimestampFormat = time.StampMilli
+	logrus.SetFormatter(customFormatter)
+	customFormatter.FullTimestamp = true
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	err := cmd.run(os.Args[2:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", os.Args[0])
+	for name, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, cmd.description)
+	}
+}
+
+// gatewayFlags are the flags that every command needs to set up a session with the gateway
+type gatewayFlags struct {
+	ip      string
+	pin     uint
+	verbose bool
+}
+
+func (g *gatewayFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&g.ip, "gateway", "", "IP address of the gateway, discovered when empty")
+	flags.UintVar(&g.pin, "pin", 0, "PIN to register with")
+	flags.BoolVar(&g.verbose, "verbose", false, "enable debug logging")
+}
+
+// connect sets up a session with the gateway, the returned function closes it again
+func (g *gatewayFlags) connect() (*comfoconnect.Session, func(), error) {
+	if g.verbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	if g.ip == "" {
+		gateways, err := comfoconnect.DiscoverGateways(context.Background(), "")
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "discovering gateway")
+		}
+		if len(gateways) != 1 {
+			return nil, nil, errors.New(fmt.Sprintf("found %d gateways, pass -gateway to pick one", len(gateways)))
+		}
+		g.ip = gateways[0].IP
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	session, err := comfoconnect.NewSession(ctx, wg, g.ip, uint32(g.pin), nil)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	return session, func() {
+		cancel()
+		wg.Wait()
+		session.Close()
+	}, nil
+}
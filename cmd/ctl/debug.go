@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
+	"github.com/hsmade/comfoconnectbridge/proto"
+)
+
+func runDebug(args []string) error {
+	var gateway gatewayFlags
+	flags := flag.NewFlagSet("debug", flag.ExitOnError)
+	gateway.register(flags)
+	enable := flags.Bool("enable-debug", false, "allow sending debug commands that read from the gateway")
+	confirm := flags.String("confirm", "", "repeat the command name to allow commands that write to, or reboot, the gateway")
+	argument := flags.Int("argument", 0, "argument for the debug command")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: debug [flags] <command>\n\ncommands:\n")
+		for i := int32(0); i < int32(len(proto.DebugRequest_DebugRequestCommand_name)); i++ {
+			command := proto.DebugRequest_DebugRequestCommand(i)
+			kind := "read"
+			if comfoconnect.IsDebugWriteCommand(command) {
+				kind = "write"
+			}
+			fmt.Fprintf(flags.Output(), "  %-20s %s\n", command.String(), kind)
+		}
+		fmt.Fprintf(flags.Output(), "\nflags:\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected exactly one debug command")
+	}
+	value, ok := proto.DebugRequest_DebugRequestCommand_value[flags.Arg(0)]
+	if !ok {
+		return errors.New(fmt.Sprintf("unknown debug command: %s", flags.Arg(0)))
+	}
+	command := proto.DebugRequest_DebugRequestCommand(value)
+
+	options := comfoconnect.DebugOptions{
+		Enabled: *enable,
+		Confirm: *confirm == command.String(),
+	}
+	if !options.Enabled {
+		return errors.Wrap(comfoconnect.ErrDebugDisabled, "pass -enable-debug to enable them")
+	}
+	if comfoconnect.IsDebugWriteCommand(command) && !options.Confirm {
+		return errors.Wrap(comfoconnect.ErrDebugNotConfirmed, fmt.Sprintf("pass -confirm %s to confirm", command.String()))
+	}
+
+	session, closeSession, err := gateway.connect()
+	if err != nil {
+		return errors.Wrap(err, "connecting to gateway")
+	}
+	defer closeSession()
+
+	result, err := session.Debug(command, int32(*argument), options)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s(%d): %d\n", command.String(), *argument, result)
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
+)
+
+func runDiscover(args []string) error {
+	flags := flag.NewFlagSet("discover", flag.ExitOnError)
+	iface := flags.String("interface", "", "interface to broadcast on, defaults to all interfaces")
+	timeout := flags.Duration("timeout", 3*time.Second, "how long to wait for responses")
+	asJSON := flags.Bool("json", false, "print the result as JSON")
+	_ = flags.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	gateways, err := comfoconnect.DiscoverGateways(ctx, *iface)
+	if err != nil {
+		return errors.Wrap(err, "discovering gateways")
+	}
+
+	if *asJSON {
+		b, err := json.MarshalIndent(gateways, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "encoding result")
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	fmt.Printf("%-16s %-34s %s\n", "IP", "UUID", "VERSION")
+	for _, gateway := range gateways {
+		fmt.Printf("%-16s %-34x %d\n", gateway.IP, gateway.UUID, gateway.Version)
+	}
+	return nil
+}
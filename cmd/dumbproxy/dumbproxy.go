@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"flag"
 	"os"
 	"os/signal"
 	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 
 	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
@@ -21,6 +23,20 @@ func main() {
 	logrus.SetFormatter(customFormatter)
 	customFormatter.FullTimestamp = true
 
+	gatewayIP := flag.String("gateway", "192.168.0.19", "IP address of the gateway")
+	interfaces := flag.String("interfaces", "", "comma separated interfaces to answer discovery requests on, all when empty")
+	announceIP := flag.String("announce-ip", "", "IP address to announce to apps, the address of the interface the request came in on when empty")
+	catalogFile := flag.String("pdo-catalog", "", "YAML or JSON file with PDO definitions, merged on top of the built-in catalog")
+	staleAfter := flag.Duration("metrics-stale-after", comfoconnect.DefaultStaleAfter, "stop exporting PDOs that weren't received for this long")
+	flag.Parse()
+
+	if *catalogFile != "" {
+		err := comfoconnect.LoadCatalogFile(*catalogFile)
+		if err != nil {
+			logrus.Fatalf("failed to load PDO catalog: %v", err)
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	wg := &sync.WaitGroup{}
 
@@ -31,7 +47,7 @@ func main() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 
-	gatewayUUID, err := comfoconnect.DiscoverGateway("192.168.0.19")
+	gatewayUUID, err := comfoconnect.DiscoverGateway(*gatewayIP)
 	if err != nil {
 		logrus.Errorf("failed to discover gateway: %v", err)
 		return
@@ -39,13 +55,22 @@ func main() {
 
 	logrus.Infof("got gateway UUID: %x", gatewayUUID)
 
-	l := comfoconnect.NewBroadcastListener("192.168.178.52", gatewayUUID)
+	l, err := comfoconnect.NewBroadcastListener("", comfoconnect.SplitInterfaces(*interfaces), []comfoconnect.Gateway{{
+		IP:   *announceIP,
+		UUID: gatewayUUID,
+	}})
+	if err != nil {
+		logrus.Errorf("failed to create broadcast listener: %v", err)
+		return
+	}
 	go l.Run()
 	defer l.Stop()
 
 	p := dumbproxy.DumbProxy{
-		GatewayIP: "192.168.0.19",
+		GatewayIP: *gatewayIP,
+		State:     comfoconnect.NewStateStore(),
 	}
+	prometheus.MustRegister(instrumentation.NewPdoCollector(p.State, *staleAfter))
 	go p.Run(ctx, wg)
 
 	logrus.Info("waiting for ctrl-c")
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"os"
 	"os/signal"
 	"time"
@@ -20,16 +21,26 @@ func main() {
 	logrus.SetFormatter(customFormatter)
 	customFormatter.FullTimestamp = true
 
+	interfaces := flag.String("interfaces", "", "comma separated interfaces to answer discovery requests on, all when empty")
+	announceIP := flag.String("announce-ip", "", "IP address to announce, the address of the interface the request came in on when empty")
+	flag.Parse()
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 
 	//l := bridge.NewBroadcastListener("192.168.178.2", []byte{0x88, 0xe9, 0xfe, 0x51, 0xc5, 0x46})
 	//l := comfoconnect.NewBroadcastListener("192.168.178.21", []byte{0x70, 0x85, 0xc2, 0xb7, 0x8c, 0xa0})
-	l := comfoconnect.NewBroadcastListener("192.168.178.21", []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x25, 0x10, 0x10, 0x80, 0x01, 0xe2, 0x03, 0x56, 0x7c, 0x4d, 0x2c})
+	l, err := comfoconnect.NewBroadcastListener("", comfoconnect.SplitInterfaces(*interfaces), []comfoconnect.Gateway{{
+		IP:   *announceIP,
+		UUID: []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x25, 0x10, 0x10, 0x80, 0x01, 0xe2, 0x03, 0x56, 0x7c, 0x4d, 0x2c},
+	}})
+	if err != nil {
+		logrus.Fatalf("failed to create broadcast listener: %v", err)
+	}
 	go l.Run()
 	defer l.Stop()
 
-	b := mockLanC.NewMockLanC("192.168.178.21", "")
+	b := mockLanC.NewMockLanC(*announceIP, "")
 	go b.Run()
 	defer b.Stop()
 
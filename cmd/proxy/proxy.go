@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"flag"
+	"net/http"
 	"os"
 	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 
 	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
@@ -21,6 +25,35 @@ func main() {
 	logrus.SetFormatter(customFormatter)
 	customFormatter.FullTimestamp = true
 
+	gatewayIP := flag.String("gateway", "192.168.0.19", "IP address of the gateway")
+	interfaces := flag.String("interfaces", "", "comma separated interfaces to answer discovery requests on, all when empty")
+	announceIP := flag.String("announce-ip", "", "IP address to announce to apps, the address of the interface the request came in on when empty")
+	catalogFile := flag.String("pdo-catalog", "", "YAML or JSON file with PDO definitions, merged on top of the built-in catalog")
+	staleAfter := flag.Duration("metrics-stale-after", comfoconnect.DefaultStaleAfter, "stop exporting PDOs that weren't received for this long")
+	queueSize := flag.Int("app-queue-size", proxy.DefaultQueueSize, "number of messages that can be queued for an app")
+	overflow := flag.String("app-queue-overflow", string(proxy.OverflowDropOldest), "what to do when the queue of an app is full: drop-oldest or disconnect")
+	transparent := flag.Bool("transparent", false, "forward messages as they were received, instead of decoding and encoding them, to keep fields that are unknown to the proxy")
+	pin := flag.Uint("pin", 0, "the PIN apps need to register with the proxy")
+	registrationsFile := flag.String("registered-apps", "registered-apps.json", "file to keep the apps that registered with the proxy in")
+	policiesFile := flag.String("policies", "", "YAML or JSON file with what each app may send to the gateway, reloaded on SIGHUP")
+	auditFile := flag.String("audit-log", "", "JSON-lines file to log the state-changing requests of the apps to, disabled when empty")
+	auditMaxSize := flag.Int64("audit-log-max-size", proxy.DefaultAuditMaxSize, "size in bytes at which the audit log is rotated")
+	auditMaxFiles := flag.Int("audit-log-max-files", proxy.DefaultAuditMaxFiles, "number of rotated audit logs to keep")
+	apiToken := flag.String("api-token", "", "bearer token for /audit, /apps and /apps/kick on the metrics port, which aren't served when empty")
+	subscribeCatalog := flag.Bool("subscribe-catalog", false, "subscribe to all PDOs in the catalog for the metrics, instead of only exporting what the apps subscribed to")
+	flag.Parse()
+
+	if *overflow != string(proxy.OverflowDropOldest) && *overflow != string(proxy.OverflowDisconnect) {
+		logrus.Fatalf("invalid -app-queue-overflow: %s", *overflow)
+	}
+
+	if *catalogFile != "" {
+		err := comfoconnect.LoadCatalogFile(*catalogFile)
+		if err != nil {
+			logrus.Fatalf("failed to load PDO catalog: %v", err)
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	wg := &sync.WaitGroup{}
 
@@ -31,11 +64,71 @@ func main() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 
-	l := comfoconnect.NewBroadcastListener("192.168.178.52", []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x25, 0x10, 0x10, 0x80, 0x01, 0xb8, 0x27, 0xeb, 0xf9, 0xf9, 0x12})
+	l, err := comfoconnect.NewBroadcastListener("", comfoconnect.SplitInterfaces(*interfaces), []comfoconnect.Gateway{{
+		IP:   *announceIP,
+		UUID: []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x25, 0x10, 0x10, 0x80, 0x01, 0xb8, 0x27, 0xeb, 0xf9, 0xf9, 0x12},
+	}})
+	if err != nil {
+		logrus.Fatalf("failed to create broadcast listener: %v", err)
+	}
 	go l.Run()
 	defer l.Stop()
 
-	p := proxy.NewProxy("192.168.0.19", []byte{0xb8, 0x27, 0xeb, 0xf9, 0xf9, 0x12})
+	p := proxy.NewProxy(*gatewayIP, []byte{0xb8, 0x27, 0xeb, 0xf9, 0xf9, 0x12})
+	p.SetAppQueue(*queueSize, proxy.OverflowPolicy(*overflow))
+	p.SetTransparent(*transparent)
+	registrations, err := proxy.NewRegistrations(*registrationsFile, uint32(*pin))
+	if err != nil {
+		logrus.Fatalf("failed to load registered apps: %v", err)
+	}
+	p.SetRegistrations(registrations)
+	policies, err := proxy.NewPolicies(*policiesFile)
+	if err != nil {
+		logrus.Fatalf("failed to load policies: %v", err)
+	}
+	p.SetPolicies(policies)
+	if *auditFile != "" {
+		audit, err := proxy.NewAuditLog(*auditFile, *auditMaxSize, *auditMaxFiles)
+		if err != nil {
+			logrus.Fatalf("failed to open audit log: %v", err)
+		}
+		defer audit.Close()
+		p.SetAuditLog(audit)
+		if *apiToken != "" {
+			http.Handle("/audit", proxy.RequireToken(*apiToken, audit)) // served with the metrics
+		} else {
+			logrus.Info("not serving /audit, there is no -api-token")
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logrus.Info("reloading policies")
+			err := policies.Reload()
+			if err != nil {
+				logrus.Errorf("failed to reload policies, keeping the old ones: %v", err)
+			}
+		}
+	}()
+	if *apiToken != "" {
+		http.Handle("/apps", proxy.RequireToken(*apiToken, p.Apps()))                    // GET lists the connected apps
+		http.Handle("/apps/kick", proxy.RequireToken(*apiToken, p.Apps().KickHandler())) // DELETE with ?id= kicks one
+	} else {
+		logrus.Info("not serving /apps, there is no -api-token")
+	}
+	prometheus.MustRegister(instrumentation.NewPdoCollector(p.State, *staleAfter))
+	if *subscribeCatalog {
+		var subscriptions []comfoconnect.Subscription
+		for _, definition := range comfoconnect.GetCatalog().Definitions() {
+			subscriptions = append(subscriptions, comfoconnect.Subscription{Ppid: definition.ID, Type: definition.Type})
+		}
+		err := p.Subscribe(subscriptions...)
+		if err != nil {
+			logrus.Errorf("failed to subscribe to the catalog: %v", err)
+		}
+	}
 	go p.Run(ctx, wg)
 
 	logrus.Info("waiting for ctrl-c")
@@ -0,0 +1,236 @@
+package comfoconnect
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/hsmade/comfoconnectbridge/proto"
+)
+
+const adminTimeout = 5 * time.Second
+
+var ErrSerialNotConfirmed = errors.New("serial number was not confirmed")
+
+// RegisteredApp is an app as it is registered at the gateway
+type RegisteredApp struct {
+	UUID       []byte `json:"uuid"`
+	DeviceName string `json:"deviceName"`
+}
+
+// DeviceSnapshot holds the provisioning state of a gateway, taken before changing it
+type DeviceSnapshot struct {
+	TakenAt         time.Time       `json:"takenAt"`
+	SerialNumber    string          `json:"serialNumber"`
+	GatewayVersion  uint32          `json:"gatewayVersion"`
+	ComfoNetVersion uint32          `json:"comfoNetVersion"`
+	RemoteAccessID  []byte          `json:"remoteAccessId"`
+	SupportID       []byte          `json:"supportId"`
+	WebID           []byte          `json:"webId"`
+	Apps            []RegisteredApp `json:"apps"`
+}
+
+// Version returns the VersionConfirm of the gateway
+func (s *Session) Version() (*proto.VersionConfirm, error) {
+	m, err := s.Request(proto.GatewayOperation_VersionRequestType, &proto.VersionRequest{}, adminTimeout)
+	if err != nil {
+		return nil, err
+	}
+	confirm, ok := m.OperationType.(*proto.VersionConfirm)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("expected VersionConfirm but got: %v", m.String()))
+	}
+	return confirm, nil
+}
+
+// ListRegisteredApps returns the apps that are registered at the gateway
+func (s *Session) ListRegisteredApps() ([]RegisteredApp, error) {
+	m, err := s.Request(proto.GatewayOperation_ListRegisteredAppsRequestType, &proto.ListRegisteredAppsRequest{}, adminTimeout)
+	if err != nil {
+		return nil, err
+	}
+	confirm, ok := m.OperationType.(*proto.ListRegisteredAppsConfirm)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("expected ListRegisteredAppsConfirm but got: %v", m.String()))
+	}
+
+	var apps []RegisteredApp
+	for _, app := range confirm.GetApps() {
+		apps = append(apps, RegisteredApp{
+			UUID:       app.GetUuid(),
+			DeviceName: app.GetDevicename(),
+		})
+	}
+	return apps, nil
+}
+
+// Snapshot collects the registered apps, versions and IDs of the gateway
+func (s *Session) Snapshot() (DeviceSnapshot, error) {
+	log := logrus.WithFields(logrus.Fields{
+		"module": "comfoconnect",
+		"object": "Session",
+		"method": "Snapshot",
+	})
+
+	snapshot := DeviceSnapshot{TakenAt: time.Now()}
+
+	version, err := s.Version()
+	if err != nil {
+		log.Errorf("failed to get version: %v", err)
+		return snapshot, errors.Wrap(err, "getting version")
+	}
+	snapshot.SerialNumber = version.GetSerialNumber()
+	snapshot.GatewayVersion = version.GetGatewayVersion()
+	snapshot.ComfoNetVersion = version.GetComfoNetVersion()
+
+	snapshot.Apps, err = s.ListRegisteredApps()
+	if err != nil {
+		log.Errorf("failed to list registered apps: %v", err)
+		return snapshot, errors.Wrap(err, "listing registered apps")
+	}
+
+	m, err := s.Request(proto.GatewayOperation_GetRemoteAccessIdRequestType, &proto.GetRemoteAccessIdRequest{}, adminTimeout)
+	if err != nil {
+		log.Errorf("failed to get remote access id: %v", err)
+		return snapshot, errors.Wrap(err, "getting remote access id")
+	}
+	if confirm, ok := m.OperationType.(*proto.GetRemoteAccessIdConfirm); ok {
+		snapshot.RemoteAccessID = confirm.GetUuid()
+	}
+
+	m, err = s.Request(proto.GatewayOperation_GetSupportIdRequestType, &proto.GetSupportIdRequest{}, adminTimeout)
+	if err != nil {
+		log.Errorf("failed to get support id: %v", err)
+		return snapshot, errors.Wrap(err, "getting support id")
+	}
+	if confirm, ok := m.OperationType.(*proto.GetSupportIdConfirm); ok {
+		snapshot.SupportID = confirm.GetUuid()
+	}
+
+	m, err = s.Request(proto.GatewayOperation_GetWebIdRequestType, &proto.GetWebIdRequest{}, adminTimeout)
+	if err != nil {
+		log.Errorf("failed to get web id: %v", err)
+		return snapshot, errors.Wrap(err, "getting web id")
+	}
+	if confirm, ok := m.OperationType.(*proto.GetWebIdConfirm); ok {
+		snapshot.WebID = confirm.GetUuid()
+	}
+
+	log.Debugf("took snapshot: %+v", snapshot)
+	return snapshot, nil
+}
+
+// ConfirmFunc is given the snapshot that was taken before changing the gateway, to keep or show it, and returns the
+// serial number that the user typed to confirm the change
+type ConfirmFunc func(snapshot DeviceSnapshot) (string, error)
+
+// take a snapshot and check that the caller typed the serial number of the gateway we're connected to
+func (s *Session) confirmSerial(confirm ConfirmFunc) (DeviceSnapshot, error) {
+	snapshot, err := s.Snapshot()
+	if err != nil {
+		return snapshot, errors.Wrap(err, "taking snapshot")
+	}
+	confirmSerial, err := confirm(snapshot)
+	if err != nil {
+		return snapshot, errors.Wrap(err, "confirming serial number")
+	}
+	if confirmSerial == "" || confirmSerial != snapshot.SerialNumber {
+		return snapshot, errors.Wrap(ErrSerialNotConfirmed, fmt.Sprintf("gateway has serial number %s", snapshot.SerialNumber))
+	}
+	return snapshot, nil
+}
+
+// FactoryReset resets the gateway to factory defaults.
+// A snapshot is taken first and passed to `confirm`, which has to return the serial number of the gateway.
+// The gateway doesn't confirm a factory reset, it closes the connection instead.
+func (s *Session) FactoryReset(resetKey []byte, confirm ConfirmFunc) (DeviceSnapshot, error) {
+	log := logrus.WithFields(logrus.Fields{
+		"module": "comfoconnect",
+		"object": "Session",
+		"method": "FactoryReset",
+	})
+
+	snapshot, err := s.confirmSerial(confirm)
+	if err != nil {
+		log.Error(err)
+		return snapshot, err
+	}
+
+	log.Warnf("factory resetting gateway %s", snapshot.SerialNumber)
+	reference := s.nextReference()
+	operationType := proto.GatewayOperation_FactoryResetType
+	err = s.Send(Message{
+		Src: s.Src,
+		Dst: s.Dst,
+		Operation: proto.GatewayOperation{
+			Type:      &operationType,
+			Reference: &reference,
+		},
+		OperationType: &proto.FactoryReset{ResetKey: resetKey},
+		Span:          opentracing.StartSpan("comfoconnect.Session.FactoryReset"),
+	})
+	if err != nil {
+		log.Errorf("failed to send FactoryReset: %v", err)
+		return snapshot, errors.Wrap(err, "sending FactoryReset")
+	}
+	return snapshot, nil
+}
+
+// SetDeviceSettings sets the MAC address and serial number of the gateway.
+// A snapshot is taken first and passed to `confirm`, which has to return the current serial number of the gateway.
+func (s *Session) SetDeviceSettings(macAddress []byte, serialNumber string, confirm ConfirmFunc) (DeviceSnapshot, error) {
+	log := logrus.WithFields(logrus.Fields{
+		"module":       "comfoconnect",
+		"object":       "Session",
+		"method":       "SetDeviceSettings",
+		"macAddress":   fmt.Sprintf("%x", macAddress),
+		"serialNumber": serialNumber,
+	})
+
+	snapshot, err := s.confirmSerial(confirm)
+	if err != nil {
+		log.Error(err)
+		return snapshot, err
+	}
+
+	log.Warnf("changing device settings of gateway %s", snapshot.SerialNumber)
+	_, err = s.Request(proto.GatewayOperation_SetDeviceSettingsRequestType, &proto.SetDeviceSettingsRequest{
+		MacAddress:   macAddress,
+		SerialNumber: &serialNumber,
+	}, adminTimeout)
+	if err != nil {
+		log.Errorf("failed to set device settings: %v", err)
+		return snapshot, errors.Wrap(err, "setting device settings")
+	}
+	return snapshot, nil
+}
+
+// SetAddress sets the UUID of the gateway.
+// A snapshot is taken first and passed to `confirm`, which has to return the serial number of the gateway.
+func (s *Session) SetAddress(uuid []byte, confirm ConfirmFunc) (DeviceSnapshot, error) {
+	log := logrus.WithFields(logrus.Fields{
+		"module": "comfoconnect",
+		"object": "Session",
+		"method": "SetAddress",
+		"uuid":   fmt.Sprintf("%x", uuid),
+	})
+
+	snapshot, err := s.confirmSerial(confirm)
+	if err != nil {
+		log.Error(err)
+		return snapshot, err
+	}
+
+	log.Warnf("changing address of gateway %s", snapshot.SerialNumber)
+	_, err = s.Request(proto.GatewayOperation_SetAddressRequestType, &proto.SetAddressRequest{
+		Uuid: uuid,
+	}, adminTimeout)
+	if err != nil {
+		log.Errorf("failed to set address: %v", err)
+		return snapshot, errors.Wrap(err, "setting address")
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,112 @@
+package comfoconnect_test
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
+	"github.com/hsmade/comfoconnectbridge/pkg/mockLanC"
+)
+
+func TestAdministration(t *testing.T) {
+	const serial = "DEM0116371204" // of the mock gateway
+
+	tests := []struct {
+		name       string
+		operation  func(m *mockLanC.MockLanC, session *comfoconnect.Session, confirm comfoconnect.ConfirmFunc) error
+		typed      string // the serial number that is typed to confirm
+		wantErr    error
+		wantReset  bool   // whether the gateway was reset, which closes the connection
+		wantSerial string // of the gateway afterwards
+	}{
+		{
+			name: "factory reset",
+			operation: func(m *mockLanC.MockLanC, session *comfoconnect.Session, confirm comfoconnect.ConfirmFunc) error {
+				_, err := session.FactoryReset(m.ResetKey, confirm)
+				return err
+			},
+			typed:      serial,
+			wantReset:  true,
+			wantSerial: serial,
+		},
+		{
+			name: "factory reset with the wrong key",
+			operation: func(m *mockLanC.MockLanC, session *comfoconnect.Session, confirm comfoconnect.ConfirmFunc) error {
+				_, err := session.FactoryReset([]byte{0x01}, confirm)
+				return err
+			},
+			typed:      serial,
+			wantSerial: serial,
+		},
+		{
+			name: "factory reset with the wrong serial",
+			operation: func(m *mockLanC.MockLanC, session *comfoconnect.Session, confirm comfoconnect.ConfirmFunc) error {
+				_, err := session.FactoryReset(m.ResetKey, confirm)
+				return err
+			},
+			typed:      "DEM0000000000",
+			wantErr:    comfoconnect.ErrSerialNotConfirmed,
+			wantSerial: serial,
+		},
+		{
+			name: "set device settings",
+			operation: func(m *mockLanC.MockLanC, session *comfoconnect.Session, confirm comfoconnect.ConfirmFunc) error {
+				_, err := session.SetDeviceSettings([]byte{1, 2, 3, 4, 5, 6}, "DEM0000000001", confirm)
+				return err
+			},
+			typed:      serial,
+			wantSerial: "DEM0000000001",
+		},
+		{
+			name: "set device settings without serial",
+			operation: func(m *mockLanC.MockLanC, session *comfoconnect.Session, confirm comfoconnect.ConfirmFunc) error {
+				_, err := session.SetDeviceSettings([]byte{1, 2, 3, 4, 5, 6}, "DEM0000000001", confirm)
+				return err
+			},
+			wantErr:    comfoconnect.ErrSerialNotConfirmed,
+			wantSerial: serial,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, session, stop := startMock(t)
+			defer stop()
+
+			confirmed := 0
+			err := tt.operation(m, session, func(snapshot comfoconnect.DeviceSnapshot) (string, error) {
+				confirmed++
+				if snapshot.SerialNumber != serial || len(snapshot.RemoteAccessID) == 0 {
+					t.Errorf("confirming with snapshot %+v, want one of the gateway before the change", snapshot)
+				}
+				return tt.typed, nil
+			})
+			if errors.Cause(err) != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if confirmed != 1 {
+				t.Errorf("confirmed %d times, want once", confirmed)
+			}
+
+			// the gateway handles messages in order, so this is answered after the operation was handled
+			_, err = session.Version()
+			if reset := err != nil; reset != tt.wantReset {
+				t.Fatalf("reset is %v (%v), want %v", reset, err, tt.wantReset)
+			}
+
+			after, stopAfter := connectMock(t)
+			defer stopAfter()
+			snapshot, err := after.Snapshot()
+			if err != nil {
+				t.Fatalf("taking snapshot afterwards: %v", err)
+			}
+			if snapshot.SerialNumber != tt.wantSerial {
+				t.Errorf("serial number is %s, want %s", snapshot.SerialNumber, tt.wantSerial)
+			}
+			if reset := len(snapshot.RemoteAccessID) == 0; reset != tt.wantReset {
+				t.Errorf("remote access id is %x, want reset: %v", snapshot.RemoteAccessID, tt.wantReset)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+//go:build linux
+// +build linux
+
+package comfoconnect
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// listenOnInterface binds a UDP socket to `port` on the interface `name` only, so broadcasts on the other interfaces
+// aren't received. Binding to a device needs CAP_NET_RAW on older kernels.
+func listenOnInterface(name string, port int) (*net.UDPConn, error) {
+	conn, err := listenShared(name, fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("binding to %s", name))
+	}
+	return conn, nil
+}
+
+// listenOnAll binds a UDP socket to `address` on all interfaces, next to the sockets bound to one interface
+func listenOnAll(address string) (*net.UDPConn, error) {
+	return listenShared("", address)
+}
+
+// listenShared binds a UDP socket to `address` that shares its port with the other discovery sockets, and binds it
+// to the interface `name` when that isn't empty
+func listenShared(name string, address string) (*net.UDPConn, error) {
+	config := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			controlErr := c.Control(func(fd uintptr) {
+				// several sockets share the port, one per interface
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+				if err == nil && name != "" {
+					err = syscall.BindToDevice(int(fd), name)
+				}
+			})
+			if controlErr != nil {
+				return controlErr
+			}
+			return err
+		},
+	}
+	conn, err := config.ListenPacket(context.Background(), "udp4", address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
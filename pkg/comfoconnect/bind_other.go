@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package comfoconnect
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// listenOnInterface isn't supported here, requests are filtered on the networks of the interface instead
+func listenOnInterface(name string, port int) (*net.UDPConn, error) {
+	return nil, errors.New("binding to an interface is only supported on linux")
+}
+
+// listenOnAll binds a UDP socket to `address` on all interfaces, it's the only discovery socket here
+func listenOnAll(address string) (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP("udp4", addr)
+}
@@ -1,78 +1,199 @@
 package comfoconnect
 
 import (
+	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/sirupsen/logrus"
+
+	"github.com/hsmade/comfoconnectbridge/proto"
 )
 
+// BroadcastListener answers SearchGatewayRequests with a SearchGatewayResponse for each of its identities
 type BroadcastListener struct {
-	ResponseIP string
-	myUUID     []byte
-	listener   *net.UDPConn
+	lock       sync.Mutex
+	identities []Gateway
+	sockets    []*discoverySocket
 	quit       chan bool
 	exited     chan bool
+	stopOnce   sync.Once
+}
+
+// discoverySocket receives the SearchGatewayRequests of one interface, or of all interfaces when iface is empty
+type discoverySocket struct {
+	iface    string
+	networks []*net.IPNet // only answer requests from these networks, or from anywhere when empty
+	conn     *net.UDPConn
 }
 
-func NewBroadcastListener(myIP string, myUUID []byte) *BroadcastListener {
+// NewBroadcastListener binds to `address` (":56747" when empty) and announces `identities`.
+// When `interfaces` is not empty, it binds to each of those interfaces on the port of `address` instead, and only
+// answers requests coming from the networks on them. Identities without an IP are announced with the IP of the
+// interface the request came in on.
+func NewBroadcastListener(address string, interfaces []string, identities []Gateway) (*BroadcastListener, error) {
 	log := logrus.WithFields(logrus.Fields{
-		"module": "proxy",
+		"module": "comfoconnect",
 		"method": "NewBroadcastListener",
 	})
 
-	addr, err := net.ResolveUDPAddr("udp4", ":56747")
-	if err != nil {
-		log.Fatalf("failed to resolve address: %v", err)
+	if address == "" {
+		address = fmt.Sprintf(":%d", discoveryPort)
 	}
-
-	listener, err := net.ListenUDP("udp4", addr)
+	addr, err := net.ResolveUDPAddr("udp4", address)
 	if err != nil {
-		log.Fatalf("failed to create listener: %v", err)
+		log.Errorf("failed to resolve address: %v", err)
+		return nil, errors.Wrap(err, fmt.Sprintf("resolving address %s", address))
 	}
 
 	l := BroadcastListener{
-		ResponseIP: myIP,
-		myUUID:     myUUID,
-		listener:   listener,
-		quit:       make(chan bool),
-		exited:     make(chan bool),
+		quit:   make(chan bool),
+		exited: make(chan bool),
+	}
+	l.SetIdentities(identities)
+
+	if len(interfaces) == 0 {
+		conn, err := net.ListenUDP("udp4", addr)
+		if err != nil {
+			log.Errorf("failed to create listener: %v", err)
+			return nil, errors.Wrap(err, fmt.Sprintf("listening on %s", address))
+		}
+		l.sockets = []*discoverySocket{{conn: conn}}
+		return &l, nil
+	}
+
+	// interfaces that can't be bound to are served by one socket on all interfaces, that filters on their networks
+	var fallback []*net.IPNet
+	for _, name := range interfaces {
+		networks, err := interfaceNetworks(name)
+		if err != nil {
+			l.close()
+			return nil, err
+		}
+		conn, err := listenOnInterface(name, addr.Port)
+		if err != nil {
+			log.Warnf("failed to bind to interface %s, filtering requests on its networks instead: %v", name, err)
+			fallback = append(fallback, networks...)
+			continue
+		}
+		log.Infof("listening for SearchGatewayRequests on %s", name)
+		l.sockets = append(l.sockets, &discoverySocket{iface: name, networks: networks, conn: conn})
+	}
+	if len(fallback) > 0 {
+		// shares the port with the sockets bound to an interface
+		conn, err := listenOnAll(address)
+		if err != nil {
+			l.close()
+			log.Errorf("failed to create listener: %v", err)
+			return nil, errors.Wrap(err, fmt.Sprintf("listening on %s", address))
+		}
+		l.sockets = append(l.sockets, &discoverySocket{networks: fallback, conn: conn})
+	}
+
+	return &l, nil
+}
+
+// SplitInterfaces splits a comma separated list of interface names for NewBroadcastListener, without empty items
+func SplitInterfaces(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// interfaceNetworks returns the IPv4 networks on an interface
+func interfaceNetworks(name string) ([]*net.IPNet, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("finding interface %s", name))
+	}
+	addresses, err := iface.Addrs()
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("listing addresses for interface %s", name))
+	}
+	var networks []*net.IPNet
+	for _, a := range addresses {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			networks = append(networks, ipNet)
+		}
 	}
+	if len(networks) == 0 {
+		return nil, errors.New(fmt.Sprintf("no IPv4 addresses found on interface %s", name))
+	}
+	return networks, nil
+}
 
-	return &l
+// SetIdentities replaces the identities that are announced
+func (l *BroadcastListener) SetIdentities(identities []Gateway) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.identities = make([]Gateway, len(identities))
+	copy(l.identities, identities)
+}
+
+// Identities returns the identities that are announced
+func (l *BroadcastListener) Identities() []Gateway {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	identities := make([]Gateway, len(l.identities))
+	copy(identities, l.identities)
+	return identities
 }
 
 func (l *BroadcastListener) Run() {
 	log := logrus.WithFields(logrus.Fields{
-		"module": "proxy",
+		"module": "comfoconnect",
 		"object": "BroadcastListener",
 		"method": "Run",
 	})
 
 	log.Debug("Starting")
+	var sockets sync.WaitGroup
+	for _, socket := range l.sockets {
+		sockets.Add(1)
+		go func(socket *discoverySocket) {
+			l.serve(socket)
+			sockets.Done()
+		}(socket)
+	}
+	sockets.Wait()
+	close(l.exited)
+}
+
+// serve answers the requests on one socket, until the listener is stopped
+func (l *BroadcastListener) serve(socket *discoverySocket) {
+	log := logrus.WithFields(logrus.Fields{
+		"module":    "comfoconnect",
+		"object":    "BroadcastListener",
+		"method":    "serve",
+		"interface": socket.iface,
+	})
+
 	var handlers sync.WaitGroup
 	for {
 		select {
 		case <-l.quit:
 			log.Info("Shutting down")
-			//l.listener.Close()
 			handlers.Wait()
-			close(l.exited)
 			return
 
 		default:
-			err := l.listener.SetReadDeadline(time.Now().Add(time.Second * 5))
+			err := socket.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
 			if err != nil {
 				log.Errorf("failed to set read deadline: %v", err)
 				continue
 			}
 
-			b := make([]byte, 2)
+			b := make([]byte, 1024)
 			//log.Debug("waiting for UDP broadcast")
-			_, addr, err := l.listener.ReadFromUDP(b)
+			length, addr, err := socket.conn.ReadFromUDP(b)
 			if err != nil {
 				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
 					continue
@@ -80,48 +201,120 @@ func (l *BroadcastListener) Run() {
 				log.Errorf("failed to accept connection: %v", err)
 				continue
 			}
-			log.Debugf("Received: %v from %v", b, addr.String())
-
-			if addr != nil {
-				handlers.Add(1)
-				go func() {
-					err := l.handleConnection(addr)
-					if err != nil {
-						log.Errorf("failed to handle connection: %v", err)
-					}
-					handlers.Done()
-				}()
+			log.Debugf("Received: %x from %v", b[:length], addr.String())
+
+			if !l.isSearchGatewayRequest(b[:length]) {
+				log.Debugf("ignoring packet from %v that isn't a SearchGatewayRequest", addr.String())
+				continue
+			}
+			if !socket.isAllowed(addr.IP) {
+				log.Debugf("ignoring SearchGatewayRequest from %v, which isn't on one of our interfaces", addr.String())
+				continue
+			}
+
+			handlers.Add(1)
+			go func() {
+				err := l.handleConnection(socket, addr)
+				if err != nil {
+					log.Errorf("failed to handle connection: %v", err)
+				}
+				handlers.Done()
+			}()
+		}
+	}
+}
+
+func (l *BroadcastListener) isSearchGatewayRequest(b []byte) bool {
+	operation := proto.DiscoveryOperation{}
+	err := operation.XXX_Unmarshal(b)
+	if err != nil {
+		return false
+	}
+	return operation.GetSearchGatewayRequest() != nil
+}
+
+func (s *discoverySocket) isAllowed(ip net.IP) bool {
+	if len(s.networks) == 0 {
+		return true
+	}
+	for _, network := range s.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// localIP returns our IP on the network of `remote`, to announce on
+func (s *discoverySocket) localIP(remote net.IP) (string, error) {
+	networks := s.networks
+	if len(networks) == 0 {
+		addresses, err := net.InterfaceAddrs()
+		if err != nil {
+			return "", errors.Wrap(err, "listing addresses")
+		}
+		for _, a := range addresses {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				networks = append(networks, ipNet)
 			}
 		}
 	}
+	for _, network := range networks {
+		if network.Contains(remote) {
+			return network.IP.String(), nil
+		}
+	}
+	if s.iface != "" && len(networks) > 0 {
+		return networks[0].IP.String(), nil
+	}
+	return "", errors.New(fmt.Sprintf("no address on the network of %s", remote))
 }
 
-func (l *BroadcastListener) handleConnection(addr *net.UDPAddr) error {
+func (l *BroadcastListener) handleConnection(socket *discoverySocket, addr *net.UDPAddr) error {
 	log := logrus.WithFields(logrus.Fields{
-		"module": "proxy",
-		"object": "BroadcastListener",
-		"method": "handleConnection",
+		"module":    "comfoconnect",
+		"object":    "BroadcastListener",
+		"method":    "handleConnection",
+		"interface": socket.iface,
 	})
 
-	log.Debug("writing searchGatewayResponse")
-	_, err := l.listener.WriteToUDP(CreateSearchGatewayResponse(l.ResponseIP, l.myUUID), addr)
-	if err != nil {
-		log.Errorf("Failed to respond to SearchGatewayRequest: %v", err)
-		return errors.Wrap(err, "responding to SearchGatewayRequest")
+	for _, identity := range l.Identities() {
+		if identity.IP == "" {
+			ip, err := socket.localIP(addr.IP)
+			if err != nil {
+				log.Warnf("not announcing %x to %v: %v", identity.UUID, addr, err)
+				continue
+			}
+			identity.IP = ip
+		}
+		log.Debugf("writing searchGatewayResponse for %v", identity)
+		_, err := socket.conn.WriteToUDP(createSearchGatewayResponse(identity), addr)
+		if err != nil {
+			log.Errorf("Failed to respond to SearchGatewayRequest: %v", err)
+			return errors.Wrap(err, "responding to SearchGatewayRequest")
+		}
 	}
 	return nil
 }
 
+func (l *BroadcastListener) close() {
+	for _, socket := range l.sockets {
+		_ = socket.conn.Close()
+	}
+}
+
 func (l *BroadcastListener) Stop() {
 	log := logrus.WithFields(logrus.Fields{
-		"module": "proxy",
+		"module": "comfoconnect",
 		"object": "BroadcastListener",
 		"method": "Stop",
 	})
 
-	log.Debugf("Stopping")
-	l.listener.Close()
-	close(l.quit)
-	<-l.exited
-	log.Info("Stopped")
+	l.stopOnce.Do(func() {
+		log.Debugf("Stopping")
+		close(l.quit)
+		l.close()
+		<-l.exited
+		log.Info("Stopped")
+	})
 }
@@ -0,0 +1,179 @@
+package comfoconnect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// PdoDefinition describes what a PDO means and how to decode it
+type PdoDefinition struct {
+	ID       uint32      `json:"id" yaml:"id"`
+	Name     string      `json:"name" yaml:"name"`
+	Type     PdoType     `json:"type" yaml:"type"`
+	Unit     string      `json:"unit,omitempty" yaml:"unit,omitempty"`
+	Scale    float64     `json:"scale,omitempty" yaml:"scale,omitempty"`
+	Category string      `json:"category,omitempty" yaml:"category,omitempty"`
+	Enum     []EnumValue `json:"enum,omitempty" yaml:"enum,omitempty"`
+
+	// Cumulative is set for totals that only go up: "year" when the total restarts every year, or "lifetime"
+	Cumulative string `json:"cumulative,omitempty" yaml:"cumulative,omitempty"`
+}
+
+// the kinds of cumulative PDOs
+const (
+	CumulativeYear     = "year"
+	CumulativeLifetime = "lifetime"
+)
+
+// EnumValue is one of the symbolic values a PDO can have
+type EnumValue struct {
+	Value int64  `json:"value" yaml:"value"`
+	Name  string `json:"name" yaml:"name"`
+}
+
+// Catalog holds the definitions of all known PDOs
+type Catalog struct {
+	definitions map[uint32]PdoDefinition
+}
+
+var (
+	catalogLock    sync.RWMutex
+	currentCatalog = NewCatalog(defaultPdoDefinitions)
+
+	// the PPIDs that were decoded without a definition, to warn only once about each
+	unknownPpidsLock sync.Mutex
+	unknownPpids     = make(map[uint32]bool)
+)
+
+// NewCatalog creates a catalog from a list of definitions
+func NewCatalog(definitions []PdoDefinition) *Catalog {
+	c := Catalog{definitions: make(map[uint32]PdoDefinition, len(definitions))}
+	for _, definition := range definitions {
+		c.definitions[definition.ID] = definition
+	}
+	return &c
+}
+
+// GetCatalog returns the catalog that is currently in use
+func GetCatalog() *Catalog {
+	catalogLock.RLock()
+	defer catalogLock.RUnlock()
+	return currentCatalog
+}
+
+// SetCatalog replaces the catalog that is in use
+func SetCatalog(c *Catalog) {
+	catalogLock.Lock()
+	defer catalogLock.Unlock()
+	currentCatalog = c
+}
+
+// LoadCatalogFile reads definitions from a YAML or JSON file (by extension) and merges them
+// on top of the default catalog, which is then used from now on.
+func LoadCatalogFile(path string) error {
+	log := logrus.WithFields(logrus.Fields{
+		"module": "comfoconnect",
+		"method": "LoadCatalogFile",
+		"path":   path,
+	})
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Errorf("failed to read catalog: %v", err)
+		return errors.Wrap(err, fmt.Sprintf("reading catalog %s", path))
+	}
+
+	var definitions []PdoDefinition
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(b, &definitions)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(b, &definitions)
+	default:
+		err = errors.New("unknown extension, expected .json, .yaml or .yml")
+	}
+	if err != nil {
+		log.Errorf("failed to parse catalog: %v", err)
+		return errors.Wrap(err, fmt.Sprintf("parsing catalog %s", path))
+	}
+
+	for _, definition := range definitions {
+		if definition.ID == 0 {
+			return errors.New(fmt.Sprintf("catalog %s contains a definition without an id: %+v", path, definition))
+		}
+		if definition.Cumulative != "" && definition.Cumulative != CumulativeYear && definition.Cumulative != CumulativeLifetime {
+			return errors.New(fmt.Sprintf("catalog %s contains an invalid cumulative for ppid %d: %s", path, definition.ID, definition.Cumulative))
+		}
+		seen := make(map[int64]bool, len(definition.Enum))
+		for _, state := range definition.Enum {
+			if seen[state.Value] || state.Name == "" {
+				return errors.New(fmt.Sprintf("catalog %s contains an invalid enum for ppid %d: %+v", path, definition.ID, definition.Enum))
+			}
+			seen[state.Value] = true
+		}
+	}
+
+	c := NewCatalog(defaultPdoDefinitions)
+	c.Merge(definitions)
+	SetCatalog(c)
+	log.Infof("loaded %d definitions, catalog now has %d", len(definitions), len(c.definitions))
+	return nil
+}
+
+// Merge adds the definitions to the catalog, replacing definitions with the same ID
+func (c *Catalog) Merge(definitions []PdoDefinition) {
+	for _, definition := range definitions {
+		c.definitions[definition.ID] = definition
+	}
+}
+
+// Get returns the definition for a PDO
+func (c *Catalog) Get(ppid uint32) (PdoDefinition, bool) {
+	definition, ok := c.definitions[ppid]
+	return definition, ok
+}
+
+// Definitions returns all definitions, sorted by ID
+func (c *Catalog) Definitions() []PdoDefinition {
+	definitions := make([]PdoDefinition, 0, len(c.definitions))
+	for _, definition := range c.definitions {
+		definitions = append(definitions, definition)
+	}
+	sort.Slice(definitions, func(i, j int) bool {
+		return definitions[i].ID < definitions[j].ID
+	})
+	return definitions
+}
+
+// Decode creates the decoder for a PDO, based on its definition
+func (c *Catalog) Decode(ppid uint32, data []byte) RpdoTypeConverter {
+	definition, ok := c.Get(ppid)
+	if !ok {
+		log := logrus.WithFields(logrus.Fields{
+			"module": "comfoconnect",
+			"object": "Catalog",
+			"method": "Decode",
+			"ppid":   ppid,
+		})
+		unknownPpidsLock.Lock()
+		warned := unknownPpids[ppid]
+		unknownPpids[ppid] = true
+		unknownPpidsLock.Unlock()
+		if warned {
+			log.Debugf("no definition for ppid %d", ppid)
+		} else {
+			log.Warnf("no definition for ppid %d, decoding it by length and not warning about it again", ppid)
+		}
+		return NewRpdo(ppid, pdoTypeForLength(len(data)), "unknown", 1, data)
+	}
+	return newRpdo(definition, data)
+}
@@ -0,0 +1,99 @@
+package comfoconnect
+
+// the values of PDO 49 and 56, auto is -1 as a signed byte
+var operatingModes = []EnumValue{{255, "auto"}, {1, "limited_manual"}, {5, "unlimited_manual"}}
+
+// the catalog that is used when no catalog file is loaded.
+// The bypass (227) is a percentage, only its end positions have a name.
+// Energy totals are cumulative, the year-to-date ones restart every year.
+var defaultPdoDefinitions = []PdoDefinition{
+	{ID: 16, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 33, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 37, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 42, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 49, Name: "Operating mode1", Type: PdoTypeUint8, Category: "mode", Enum: operatingModes},
+	{ID: 53, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 56, Name: "Operating mode2", Type: PdoTypeUint8, Category: "mode", Enum: operatingModes},
+	{ID: 57, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 58, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 65, Name: "Fans: Fan speed setting", Type: PdoTypeUint8, Category: "mode", Enum: []EnumValue{{0, "away"}, {1, "low"}, {2, "medium"}, {3, "high"}}},
+	{ID: 66, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 67, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 70, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 71, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 73, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 74, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 81, Name: "General: Countdown until next fan speed change", Type: PdoTypeUint32, Unit: "seconds", Category: "timer"},
+	{ID: 82, Name: "Unknown", Type: PdoTypeUint32, Category: "unknown"},
+	{ID: 85, Name: "Unknown", Type: PdoTypeUint32, Category: "unknown"},
+	{ID: 86, Name: "Unknown", Type: PdoTypeUint32, Category: "unknown"},
+	{ID: 87, Name: "Unknown", Type: PdoTypeUint32, Category: "unknown"},
+	{ID: 89, Name: "Unknown", Type: PdoTypeUint32, Category: "unknown"},
+	{ID: 90, Name: "Unknown", Type: PdoTypeUint32, Category: "unknown"},
+	{ID: 117, Name: "Fans: Exhaust fan duty", Type: PdoTypeUint8, Unit: "percent", Category: "fan_duty"},
+	{ID: 118, Name: "Fans: Supply fan duty", Type: PdoTypeUint8, Unit: "percent", Category: "fan_duty"},
+	{ID: 119, Name: "Fans: Exhaust fan flow", Type: PdoTypeUint16, Unit: "m3_per_hour", Category: "fan_flow"},
+	{ID: 120, Name: "Fans: Supply fan flow", Type: PdoTypeUint16, Unit: "m3_per_hour", Category: "fan_flow"},
+	{ID: 121, Name: "Fans: Exhaust fan speed", Type: PdoTypeUint16, Unit: "rpm", Category: "fan_speed"},
+	{ID: 122, Name: "Fans: Supply fan speed", Type: PdoTypeUint16, Unit: "rpm", Category: "fan_speed"},
+	{ID: 128, Name: "Power Consumption: Current Ventilation", Type: PdoTypeUint16, Unit: "watts", Category: "power"},
+	{ID: 129, Name: "Power Consumption: Total year-to-date", Type: PdoTypeUint16, Unit: "kwh", Category: "energy", Cumulative: CumulativeYear},
+	{ID: 130, Name: "Power Consumption: Total from start", Type: PdoTypeUint16, Unit: "kwh", Category: "energy", Cumulative: CumulativeLifetime},
+	{ID: 144, Name: "Preheater Power Consumption: Total year-to-date", Type: PdoTypeUint16, Unit: "kwh", Category: "energy", Cumulative: CumulativeYear},
+	{ID: 145, Name: "Preheater Power Consumption: Total from start", Type: PdoTypeUint16, Unit: "kwh", Category: "energy", Cumulative: CumulativeLifetime},
+	{ID: 146, Name: "Preheater Power Consumption: Current Ventilation", Type: PdoTypeUint16, Unit: "watts", Category: "power"},
+	{ID: 176, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 192, Name: "Days left before filters must be replaced", Type: PdoTypeUint16, Unit: "days", Category: "filter"},
+	{ID: 208, Name: "Unknown temperature", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 209, Name: "Current RMOT", Type: PdoTypeInt16, Unit: "celsius", Scale: 0.1, Category: "temperature"},
+	{ID: 210, Name: "Unknown", Type: PdoTypeBool, Category: "unknown"},
+	{ID: 211, Name: "Unknown", Type: PdoTypeBool, Category: "unknown"},
+	{ID: 212, Name: "Temperature profile: cool", Type: PdoTypeInt16, Unit: "celsius", Scale: 0.1, Category: "temperature"},
+	{ID: 213, Name: "Avoided Heating: Avoided actual", Type: PdoTypeUint16, Unit: "watts", Category: "power"},
+	{ID: 214, Name: "Avoided Heating: Avoided year-to-date", Type: PdoTypeUint16, Unit: "kwh", Category: "energy", Cumulative: CumulativeYear},
+	{ID: 215, Name: "Avoided Heating: Avoided total", Type: PdoTypeUint16, Unit: "kwh", Category: "energy", Cumulative: CumulativeLifetime},
+	{ID: 216, Name: "Avoided Cooling: Avoided actual", Type: PdoTypeUint16, Unit: "watts", Category: "power"},
+	{ID: 217, Name: "Avoided Cooling: Avoided year-to-date", Type: PdoTypeUint16, Unit: "kwh", Category: "energy", Cumulative: CumulativeYear},
+	{ID: 218, Name: "Avoided Cooling: Avoided total", Type: PdoTypeUint16, Unit: "kwh", Category: "energy", Cumulative: CumulativeLifetime},
+	{ID: 219, Name: "Unknown", Type: PdoTypeUint16, Category: "unknown"},
+	{ID: 220, Name: "Temperature: Outdoor Air", Type: PdoTypeInt16, Unit: "celsius", Scale: 0.1, Category: "temperature"},
+	{ID: 221, Name: "Temperature: Supply Air", Type: PdoTypeInt16, Unit: "celsius", Scale: 0.1, Category: "temperature"},
+	{ID: 224, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 225, Name: "Unknown: switches with fan", Type: PdoTypeUint8, Category: "state", Enum: []EnumValue{{1, "low"}, {2, "medium"}, {3, "high"}}},
+	{ID: 226, Name: "Unknown", Type: PdoTypeUint16, Category: "unknown"},
+	{ID: 227, Name: "Bypass state", Type: PdoTypeUint8, Unit: "percent", Category: "bypass", Enum: []EnumValue{{0, "closed"}, {100, "open"}}},
+	{ID: 228, Name: "Unknown Frost Protection Unbalance", Type: PdoTypeUint8, Category: "state"},
+	{ID: 230, Name: "Unknown", Type: PdoTypeInt64, Category: "unknown"},
+	{ID: 274, Name: "Temperature: Extract Air", Type: PdoTypeInt16, Unit: "celsius", Scale: 0.1, Category: "temperature"},
+	{ID: 275, Name: "Temperature: Exhaust Air", Type: PdoTypeInt16, Unit: "celsius", Scale: 0.1, Category: "temperature"},
+	{ID: 276, Name: "Temperature: Outdoor Air", Type: PdoTypeInt16, Unit: "celsius", Scale: 0.1, Category: "temperature"},
+	{ID: 278, Name: "PostHeaterTempBefore", Type: PdoTypeInt16, Unit: "celsius", Scale: 0.1, Category: "temperature"},
+	{ID: 290, Name: "Humidity: Extract Air", Type: PdoTypeUint8, Unit: "percent", Category: "humidity"},
+	{ID: 291, Name: "Humidity: Exhaust Air", Type: PdoTypeUint8, Unit: "percent", Category: "humidity"},
+	{ID: 292, Name: "Humidity: Outdoor Air", Type: PdoTypeUint8, Unit: "percent", Category: "humidity"},
+	{ID: 294, Name: "Humidity: Supply Air", Type: PdoTypeUint8, Unit: "percent", Category: "humidity"},
+	{ID: 321, Name: "Unknown", Type: PdoTypeUint16, Category: "unknown"},
+	{ID: 325, Name: "Unknown", Type: PdoTypeUint16, Category: "unknown"},
+	{ID: 330, Name: "Unknown", Type: PdoTypeUint16, Category: "unknown"},
+	{ID: 337, Name: "Unknown", Type: PdoTypeUint32, Category: "unknown"},
+	{ID: 338, Name: "Unknown", Type: PdoTypeUint32, Category: "unknown"},
+	{ID: 341, Name: "Unknown", Type: PdoTypeUint32, Category: "unknown"},
+	{ID: 345, Name: "Unknown", Type: PdoTypeUint32, Category: "unknown"},
+	{ID: 346, Name: "Unknown", Type: PdoTypeUint32, Category: "unknown"},
+	{ID: 369, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 370, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 371, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 372, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 384, Name: "Unknown", Type: PdoTypeInt16, Category: "unknown"},
+	{ID: 386, Name: "Unknown", Type: PdoTypeBool, Category: "unknown"},
+	{ID: 400, Name: "Unknown", Type: PdoTypeInt16, Category: "unknown"},
+	{ID: 401, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 402, Name: "Unknown Post Heater Present", Type: PdoTypeBool, Category: "state"},
+	{ID: 416, Name: "unknown Outdoor air temperature", Type: PdoTypeInt16, Unit: "celsius", Scale: 0.1, Category: "temperature"},
+	{ID: 417, Name: "unknown GHE Ground temperature", Type: PdoTypeInt16, Unit: "celsius", Scale: 0.1, Category: "temperature"},
+	{ID: 418, Name: "unknown GHE State", Type: PdoTypeUint8, Category: "state", Enum: []EnumValue{{0, "inactive"}, {1, "active"}}},
+	{ID: 419, Name: "unknown GHE Present", Type: PdoTypeBool, Category: "state"},
+	{ID: 784, Name: "Unknown", Type: PdoTypeUint8, Category: "unknown"},
+	{ID: 785, Name: "ComfoCoolCompressor State", Type: PdoTypeBool, Category: "state"},
+	{ID: 802, Name: "Unknown", Type: PdoTypeInt16, Category: "unknown"},
+}
@@ -18,6 +18,7 @@ import (
 type OperationType interface { // FIXME: rename
 	XXX_Unmarshal([]byte) error
 	XXX_Marshal(b []byte, deterministic bool) ([]byte, error)
+	XXX_Size() int
 }
 
 type Message struct {
@@ -63,7 +64,7 @@ func GetMessageFromSocket(conn net.Conn) (Message, error) {
 		span.SetTag("err", err)
 		return Message{}, err
 	}
-	log.Trace("length: %d", length)
+	log.Tracef("length: %d", length)
 
 	src, err := ReadBytes(conn, 16)
 	if err != nil {
@@ -73,7 +74,7 @@ func GetMessageFromSocket(conn net.Conn) (Message, error) {
 		return Message{}, err
 	}
 	completeMessage = append(completeMessage, src...)
-	log.Trace("Src: %x", src)
+	log.Tracef("Src: %x", src)
 
 	dst, err := ReadBytes(conn, 16)
 	if err != nil {
@@ -83,7 +84,7 @@ func GetMessageFromSocket(conn net.Conn) (Message, error) {
 		return Message{}, err
 	}
 	completeMessage = append(completeMessage, dst...)
-	log.Trace("Dst: %x", dst)
+	log.Tracef("Dst: %x", dst)
 
 	operationLengthBytes, err := ReadBytes(conn, 2)
 	if err != nil {
@@ -101,7 +102,7 @@ func GetMessageFromSocket(conn net.Conn) (Message, error) {
 		span.SetTag("err", err)
 		return Message{}, err
 	}
-	log.Trace("operationLength: %d", operationLength)
+	log.Tracef("operationLength: %d", operationLength)
 
 	operationBytes, err := ReadBytes(conn, int(operationLength))
 	if err != nil {
@@ -111,13 +112,13 @@ func GetMessageFromSocket(conn net.Conn) (Message, error) {
 		return Message{}, err
 	}
 	completeMessage = append(completeMessage, operationBytes...)
-	log.Trace("operationBytes: %x", operationBytes)
+	log.Tracef("operationBytes: %x", operationBytes)
 
 	operationTypeLength := (length - 34) - uint32(operationLength)
 	var operationTypeBytes []byte
 
 	if operationTypeLength > 0 {
-		log.Trace("operationTypeLength: %d", operationTypeLength)
+		log.Tracef("operationTypeLength: %d", operationTypeLength)
 		operationTypeBytes, err = ReadBytes(conn, int(operationTypeLength))
 		if err != nil {
 			err := errors.Wrap(err, "reading operation type")
@@ -126,7 +127,7 @@ func GetMessageFromSocket(conn net.Conn) (Message, error) {
 			return Message{}, err
 		}
 		completeMessage = append(completeMessage, operationTypeBytes...)
-		log.Trace("operationTypeBytes: %x", operationTypeBytes)
+		log.Tracef("operationTypeBytes: %x", operationTypeBytes)
 	}
 
 	operation := proto.GatewayOperation{} // FIXME: parse instead of assume
@@ -139,6 +140,18 @@ func GetMessageFromSocket(conn net.Conn) (Message, error) {
 	}
 
 	operationType := GetStructForType(operation.Type.String())
+	if operationType == nil {
+		// not in zehnder.proto, it can still be forwarded with Forward
+		message := Message{
+			Src:        src,
+			Dst:        dst,
+			Operation:  operation,
+			RawMessage: completeMessage,
+			Span:       span,
+		}
+		SpanSetMessage(span, message)
+		return message, nil
+	}
 	err = operationType.XXX_Unmarshal(operationTypeBytes)
 	if err != nil {
 		err := errors.Wrap(err, "failed to unmarshal operation type") // FIXME
@@ -213,6 +226,13 @@ func (m Message) CreateResponse(span opentracing.Span, status proto.GatewayOpera
 		//"span": span.Context().(jaeger.SpanContext).String(),
 	})
 
+	if m.OperationType == nil {
+		// not in zehnder.proto, so there is no response to create
+		log.Debugf("no response for unknown operation type: %s", m.Operation.Type.String())
+		span.SetTag("err", "unknown operation type")
+		return nil
+	}
+
 	message := m
 	message.Src = m.Dst
 	message.Dst = m.Src
@@ -230,7 +250,7 @@ func (m Message) CreateResponse(span opentracing.Span, status proto.GatewayOpera
 
 	responseStruct := GetStructForType(responseType.String())
 	if responseStruct == nil {
-		err := errors.New(fmt.Sprint("unable to find struct for type: %s", responseType.String()))
+		err := errors.New(fmt.Sprintf("unable to find struct for type: %s", responseType.String()))
 		log.Error(err)
 		span.SetTag("err", err)
 		return nil
@@ -242,9 +262,14 @@ func (m Message) CreateResponse(span opentracing.Span, status proto.GatewayOpera
 		currentTime := uint32(time.Now().Sub(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).Seconds())
 		responseStruct.(*proto.CnTimeConfirm).CurrentTime = &currentTime
 	case "StartSessionConfirmType":
-		ok := proto.GatewayOperation_OK
-		operation.Result = &ok
+		if operation.Result == nil {
+			ok := proto.GatewayOperation_OK
+			operation.Result = &ok
+		}
 	case "VersionConfirmType": // FIXME: get this from comfoconnect
+		if status != proto.GatewayOperation_OK && status != -1 {
+			break // an error has no version
+		}
 		gw := uint32(1049610)
 		cn := uint32(1073750016)
 		serial := "DEM0116371204"
@@ -254,6 +279,9 @@ func (m Message) CreateResponse(span opentracing.Span, status proto.GatewayOpera
 		ok := proto.GatewayOperation_OK
 		operation.Result = &ok
 	case "GetRemoteAccessIdConfirmType": // FIXME: get this from comfoconnect
+		if status != proto.GatewayOperation_OK && status != -1 {
+			break
+		}
 		uuid := "7m\351\332}\322C\346\270\336^G\307\223Y\\"
 		responseStruct.(*proto.GetRemoteAccessIdConfirm).Uuid = []byte(uuid)
 	case "CnRmiResponseType":
@@ -318,17 +346,21 @@ func (m Message) packMessage(operation proto.GatewayOperation, operationType Ope
 	})
 
 	operationBytes, _ := operation.XXX_Marshal(nil, false)
-	log.Trace("operationBytes: %x", operationBytes)
-	operationTypeBytes, _ := operationType.XXX_Marshal(nil, false)
-	log.Trace("operationTypeBytes: %x", operationTypeBytes)
+	log.Tracef("operationBytes: %x", operationBytes)
+	var operationTypeBytes []byte
+	if operationType != nil {
+		operationType.XXX_Size() // fills the size cache, which is needed to marshal nested messages
+		operationTypeBytes, _ = operationType.XXX_Marshal(nil, false)
+	}
+	log.Tracef("operationTypeBytes: %x", operationTypeBytes)
 	response := make([]byte, 4)
 	binary.BigEndian.PutUint32(response, uint32(len(operationTypeBytes)+34+len(operationBytes))) // raw message length
-	log.Trace("length: %x", response)
+	log.Tracef("length: %x", response)
 	response = append(response, m.Src...)
 	response = append(response, m.Dst...)
 	b := make([]byte, 2)
 	binary.BigEndian.PutUint16(b, uint16(len(operationBytes))) // op length
-	log.Trace("op length: %x", b)
+	log.Tracef("op length: %x", b)
 	response = append(response, b...)
 	response = append(response, operationBytes...) // gatewayOperation
 	response = append(response, operationTypeBytes...)
@@ -351,20 +383,25 @@ func (m Message) DecodePDO() RpdoTypeConverter {
 
 // take an IP address, and a MAC address to respond with and create search gateway response
 func CreateSearchGatewayResponse(ipAddress string, uuid []byte) []byte {
-	version := uint32(1)
-	//uuid := []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x25, 0x10, 0x10, 0x80, 0x01} // uuid header
-	//uuid = append(uuid, macAddress...)
+	return createSearchGatewayResponse(Gateway{IP: ipAddress, UUID: uuid})
+}
+
+func createSearchGatewayResponse(gateway Gateway) []byte {
+	version := gateway.Version
+	if version == 0 {
+		version = 1
+	}
 
-	resp := proto.SearchGatewayResponse{
-		Ipaddress:            &ipAddress,
-		Uuid:                 uuid,
-		Version:              &version,
-		XXX_NoUnkeyedLiteral: struct{}{},
-		XXX_unrecognized:     nil,
-		XXX_sizecache:        0,
+	resp := proto.DiscoveryOperation{
+		SearchGatewayResponse: &proto.SearchGatewayResponse{
+			Ipaddress: &gateway.IP,
+			Uuid:      gateway.UUID,
+			Version:   &version,
+		},
 	}
 
-	b, _ := resp.XXX_Marshal([]byte{0x12, 0x24}, false)
+	resp.XXX_Size()
+	b, _ := resp.XXX_Marshal(nil, false)
 	return b
 }
 
@@ -539,7 +576,7 @@ func getResponseTypeForOperationType(operationType OperationType) proto.GatewayO
 	case "ListRegisteredAppsRequest":
 		responseTypeString = proto.GatewayOperation_ListRegisteredAppsConfirmType
 	case "DeregisterAppRequest":
-		responseTypeString = proto.GatewayOperation_SetAddressConfirmType
+		responseTypeString = proto.GatewayOperation_DeregisterAppConfirmType
 	case "ChangePinRequest":
 		responseTypeString = proto.GatewayOperation_ChangePinConfirmType
 	case "GetRemoteAccessIdRequest":
@@ -621,7 +658,7 @@ func ReadBytes(conn net.Conn, size int) ([]byte, error) {
 		if readLen > 0 {
 			size -= readLen
 			result = append(result, buffer[:readLen]...)
-			log.Trace("read result now: %x, read bytes:%d", result, readLen)
+			log.Tracef("read result now: %x, read bytes:%d", result, readLen)
 		}
 
 		if size == 0 {
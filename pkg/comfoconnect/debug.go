@@ -0,0 +1,79 @@
+package comfoconnect
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/hsmade/comfoconnectbridge/proto"
+)
+
+const debugTimeout = 5 * time.Second
+
+var (
+	ErrDebugDisabled     = errors.New("debug commands are disabled")
+	ErrDebugNotConfirmed = errors.New("debug command changes the gateway and was not confirmed")
+)
+
+// DebugOptions is the safety switch for debug commands. Everything is off by default.
+type DebugOptions struct {
+	Enabled bool // allow debug commands that only read from the gateway
+	Confirm bool // also allow debug commands that write to, or reboot, the gateway
+}
+
+// IsDebugWriteCommand returns true for debug commands that change the state of the gateway
+func IsDebugWriteCommand(command proto.DebugRequest_DebugRequestCommand) bool {
+	switch command {
+	case proto.DebugRequest_DBG_ECHO,
+		proto.DebugRequest_DBG_SESSION_ECHO,
+		proto.DebugRequest_DBG_PRINT_SETTINGS,
+		proto.DebugRequest_DBG_GPI,
+		proto.DebugRequest_DBG_RS232_READ,
+		proto.DebugRequest_DBG_CAN_READ,
+		proto.DebugRequest_DBG_KNX_READ,
+		proto.DebugRequest_DBG_EEPROM_READ:
+		return false
+	default:
+		return true
+	}
+}
+
+// Debug sends a DebugRequest to the gateway and returns the result from the DebugConfirm
+func (s *Session) Debug(command proto.DebugRequest_DebugRequestCommand, argument int32, options DebugOptions) (int32, error) {
+	log := logrus.WithFields(logrus.Fields{
+		"module":   "comfoconnect",
+		"object":   "Session",
+		"method":   "Debug",
+		"command":  command.String(),
+		"argument": argument,
+	})
+
+	if !options.Enabled {
+		log.Warn(ErrDebugDisabled)
+		return 0, ErrDebugDisabled
+	}
+	if IsDebugWriteCommand(command) && !options.Confirm {
+		log.Warn(ErrDebugNotConfirmed)
+		return 0, ErrDebugNotConfirmed
+	}
+
+	log.Info("sending debug command")
+	m, err := s.Request(proto.GatewayOperation_DebugRequestType, &proto.DebugRequest{
+		Command:  &command,
+		Argument: &argument,
+	}, debugTimeout)
+	if err != nil {
+		log.Errorf("debug command failed: %v", err)
+		return 0, errors.Wrap(err, fmt.Sprintf("sending %s", command.String()))
+	}
+
+	confirm, ok := m.OperationType.(*proto.DebugConfirm)
+	if !ok {
+		err := errors.New(fmt.Sprintf("expected DebugConfirm but got: %v", m.String()))
+		log.Error(err)
+		return 0, err
+	}
+	return confirm.GetResult(), nil
+}
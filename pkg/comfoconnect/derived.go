@@ -0,0 +1,150 @@
+package comfoconnect
+
+import (
+	"math"
+)
+
+const (
+	// density (kg/m³) times specific heat (J/kg·K) of air, divided by 3600 to go from m³/h to m³/s
+	airHeatCapacityPerFlow = 1.2 * 1005 / 3600
+
+	// the efficiency is meaningless when extract and outdoor air are (almost) the same temperature
+	minEfficiencyDelta = 1.0
+)
+
+// AirProperties are the values derived from the temperature and humidity of one air stream
+type AirProperties struct {
+	DewPoint         Reading `json:"dew_point"`
+	AbsoluteHumidity Reading `json:"absolute_humidity"`
+}
+
+// Derived are values calculated from the measured PDOs.
+// A derived reading is only fresh when all of its inputs are, and it has no Updated time when it can't be calculated.
+type Derived struct {
+	HeatRecoveryEfficiency Reading       `json:"heat_recovery_efficiency"`
+	RecoveredPower         Reading       `json:"recovered_power"` // heat moved from the extract to the supply air
+	LostPower              Reading       `json:"lost_power"`      // heat that leaves the house with the exhaust air
+	Outdoor                AirProperties `json:"outdoor"`
+	Supply                 AirProperties `json:"supply"`
+	Extract                AirProperties `json:"extract"`
+	Exhaust                AirProperties `json:"exhaust"`
+}
+
+// Derive calculates the derived values from a snapshot
+func Derive(unit VentilationUnit) Derived {
+	t := unit.Temperatures
+	h := unit.Humidity
+	return Derived{
+		HeatRecoveryEfficiency: derive("percent", func(v []float64) (float64, bool) {
+			return HeatRecoveryEfficiency(v[0], v[1], v[2])
+		}, t.Outdoor, t.Supply, t.Extract),
+		RecoveredPower: derive("watts", func(v []float64) (float64, bool) {
+			return ThermalPower(v[2], v[1]-v[0]), true
+		}, t.Outdoor, t.Supply, unit.Fans.Supply.Flow),
+		LostPower: derive("watts", func(v []float64) (float64, bool) {
+			return ThermalPower(v[2], v[1]-v[0]), true
+		}, t.Outdoor, t.Exhaust, unit.Fans.Exhaust.Flow),
+		Outdoor: airProperties(t.Outdoor, h.Outdoor),
+		Supply:  airProperties(t.Supply, h.Supply),
+		Extract: airProperties(t.Extract, h.Extract),
+		Exhaust: airProperties(t.Exhaust, h.Exhaust),
+	}
+}
+
+func airProperties(temperature, humidity Reading) AirProperties {
+	return AirProperties{
+		DewPoint: derive("celsius", func(v []float64) (float64, bool) {
+			return DewPoint(v[0], v[1])
+		}, temperature, humidity),
+		AbsoluteHumidity: derive("grams_per_m3", func(v []float64) (float64, bool) {
+			return AbsoluteHumidity(v[0], v[1])
+		}, temperature, humidity),
+	}
+}
+
+// calls `f` with the values of `inputs`, when all of them were received
+func derive(unit string, f func(values []float64) (float64, bool), inputs ...Reading) Reading {
+	r := Reading{Unit: unit, Fresh: true}
+	values := make([]float64, len(inputs))
+	for i, input := range inputs {
+		if input.Updated.IsZero() {
+			return Reading{Unit: unit}
+		}
+		values[i] = input.Value
+		r.Fresh = r.Fresh && input.Fresh
+		// a derived value is as old as its oldest input
+		if r.Updated.IsZero() || input.Updated.Before(r.Updated) {
+			r.Updated = input.Updated
+		}
+	}
+
+	value, ok := f(values)
+	if !ok {
+		return Reading{Unit: unit}
+	}
+	r.Value = value
+	return r
+}
+
+// HeatRecoveryEfficiency returns the temperature ratio of the heat exchanger on the supply side, in percent
+func HeatRecoveryEfficiency(outdoor, supply, extract float64) (float64, bool) {
+	if math.Abs(extract-outdoor) < minEfficiencyDelta {
+		return 0, false
+	}
+	return (supply - outdoor) / (extract - outdoor) * 100, true
+}
+
+// ThermalPower returns the heat in watts that is carried by `flow` m³/h of air that is `delta` degrees warmer
+func ThermalPower(flow, delta float64) float64 {
+	return airHeatCapacityPerFlow * flow * delta
+}
+
+// DewPoint returns the dew point in °C, using the Magnus formula
+func DewPoint(temperature, relativeHumidity float64) (float64, bool) {
+	if relativeHumidity <= 0 || relativeHumidity > 100 {
+		return 0, false
+	}
+	const a, b = 17.62, 243.12
+	gamma := math.Log(relativeHumidity/100) + a*temperature/(b+temperature)
+	return b * gamma / (a - gamma), true
+}
+
+// AbsoluteHumidity returns the amount of water vapour in g/m³
+func AbsoluteHumidity(temperature, relativeHumidity float64) (float64, bool) {
+	if relativeHumidity < 0 || relativeHumidity > 100 {
+		return 0, false
+	}
+	saturation := 6.112 * math.Exp(17.67*temperature/(temperature+243.5)) // hPa
+	return saturation * relativeHumidity * 2.1674 / (273.15 + temperature), true
+}
+
+// DerivedReading is a derived value with its name, and the air stream it's about for the air properties
+type DerivedReading struct {
+	Name string
+	Air  string
+	Reading
+}
+
+// Readings returns the derived values, for exporting them as metrics
+func (d Derived) Readings() []DerivedReading {
+	readings := []DerivedReading{
+		{Name: "heat_recovery_efficiency", Reading: d.HeatRecoveryEfficiency},
+		{Name: "recovered_power", Reading: d.RecoveredPower},
+		{Name: "lost_power", Reading: d.LostPower},
+	}
+	for _, air := range []struct {
+		name       string
+		properties AirProperties
+	}{
+		{"outdoor", d.Outdoor},
+		{"supply", d.Supply},
+		{"extract", d.Extract},
+		{"exhaust", d.Exhaust},
+	} {
+		readings = append(readings,
+			DerivedReading{Name: "dew_point", Air: air.name, Reading: air.properties.DewPoint},
+			DerivedReading{Name: "absolute_humidity", Air: air.name, Reading: air.properties.AbsoluteHumidity},
+		)
+	}
+	return readings
+}
@@ -0,0 +1,246 @@
+package comfoconnect
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/hsmade/comfoconnectbridge/proto"
+)
+
+const (
+	discoveryPort    = 56747
+	discoveryTimeout = 2 * time.Second
+)
+
+// Gateway is a gateway as it responded to a SearchGatewayRequest
+type Gateway struct {
+	IP      string `json:"ip"`
+	UUID    []byte `json:"uuid"`
+	Version uint32 `json:"version"`
+}
+
+func (g Gateway) String() string {
+	return fmt.Sprintf("ip=%s uuid=%x version=%d", g.IP, g.UUID, g.Version)
+}
+
+// creates the DiscoveryOperation with an (empty) SearchGatewayRequest
+func createSearchGatewayRequest() []byte {
+	request := proto.DiscoveryOperation{
+		SearchGatewayRequest: &proto.SearchGatewayRequest{},
+	}
+	request.XXX_Size()
+	b, _ := request.XXX_Marshal(nil, false)
+	return b
+}
+
+// takes a DiscoveryOperation and returns the gateway from its SearchGatewayResponse
+func parseSearchGatewayResponse(b []byte) (Gateway, error) {
+	operation := proto.DiscoveryOperation{}
+	err := operation.XXX_Unmarshal(b)
+	if err != nil {
+		return Gateway{}, errors.Wrap(err, "unmarshalling DiscoveryOperation")
+	}
+
+	response := operation.GetSearchGatewayResponse()
+	if response == nil {
+		return Gateway{}, errors.New("DiscoveryOperation doesn't contain a SearchGatewayResponse")
+	}
+
+	return Gateway{
+		IP:      response.GetIpaddress(),
+		UUID:    response.GetUuid(),
+		Version: response.GetVersion(),
+	}, nil
+}
+
+// send a UDP packet to `ip` and expect a searchGatewayResponse with the uuid
+func DiscoverGateway(ip string) (uuid []byte, err error) {
+	log := logrus.WithFields(logrus.Fields{
+		"module": "comfoconnect",
+		"method": "DiscoverGateway",
+	})
+
+	raddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", ip, discoveryPort))
+	if err != nil {
+		log.Errorf("could not resolve gateway address %s: %v", ip, err)
+		return nil, errors.Wrap(err, fmt.Sprintf("resolving gateway address: %s", ip))
+	}
+
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		log.Errorf("could not connect to gateway address %s: %v", ip, err)
+		return nil, errors.Wrap(err, fmt.Sprintf("connectinng to gateway address: %s", ip))
+	}
+	defer conn.Close()
+
+	err = conn.SetReadDeadline(time.Now().Add(discoveryTimeout))
+	if err != nil {
+		log.Errorf("could not set read deadline: %v", err)
+		return nil, errors.Wrap(err, "setting read deadline")
+	}
+
+	_, err = conn.Write(createSearchGatewayRequest()) // wake up gateway
+	if err != nil {
+		log.Errorf("could write discovery packet to gateway address %s: %v", ip, err)
+		return nil, errors.Wrap(err, fmt.Sprintf("writing discovery packet to gateway address: %s", ip))
+	}
+
+	buf := make([]byte, 1024)
+	length, err := conn.Read(buf)
+	if err != nil {
+		log.Errorf("could read message from gateway address %s: %v", ip, err)
+		return nil, errors.Wrap(err, fmt.Sprintf("reading message from gateway address: %s", ip))
+	}
+
+	gateway, err := parseSearchGatewayResponse(buf[:length])
+	if err != nil {
+		log.Errorf("could not parse message from gateway address %s: %v", ip, err)
+		return nil, errors.Wrap(err, fmt.Sprintf("parsing message from gateway address: %s", ip))
+	}
+
+	return gateway.UUID, nil
+}
+
+// returns the IPv4 broadcast addresses for `iface`, or for all interfaces when `iface` is empty
+func broadcastAddresses(iface string) ([]net.IP, error) {
+	var interfaces []net.Interface
+	if iface == "" {
+		all, err := net.Interfaces()
+		if err != nil {
+			return nil, errors.Wrap(err, "listing interfaces")
+		}
+		interfaces = all
+	} else {
+		i, err := net.InterfaceByName(iface)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("finding interface %s", iface))
+		}
+		interfaces = []net.Interface{*i}
+	}
+
+	var result []net.IP
+	for _, i := range interfaces {
+		if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+		addresses, err := i.Addrs()
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("listing addresses for interface %s", i.Name))
+		}
+		for _, address := range addresses {
+			ipNet, ok := address.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipNet.IP.To4()
+			if ip == nil || len(ipNet.Mask) != net.IPv4len {
+				continue
+			}
+			broadcast := make(net.IP, net.IPv4len)
+			for n := range ip {
+				broadcast[n] = ip[n] | ^ipNet.Mask[n]
+			}
+			result = append(result, broadcast)
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, errors.New(fmt.Sprintf("no IPv4 broadcast addresses found for interface '%s'", iface))
+	}
+	return result, nil
+}
+
+// DiscoverGateways broadcasts a SearchGatewayRequest on `iface` (or all interfaces when empty),
+// and collects the responses until the context is done, or for 2 seconds when the context has no deadline.
+// Gateways that respond more than once are only returned once.
+func DiscoverGateways(ctx context.Context, iface string) ([]Gateway, error) {
+	log := logrus.WithFields(logrus.Fields{
+		"module": "comfoconnect",
+		"method": "DiscoverGateways",
+		"iface":  iface,
+	})
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, discoveryTimeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+
+	addresses, err := broadcastAddresses(iface)
+	if err != nil {
+		log.Errorf("failed to find broadcast addresses: %v", err)
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		log.Errorf("failed to create socket: %v", err)
+		return nil, errors.Wrap(err, "creating socket")
+	}
+	defer conn.Close()
+
+	for _, address := range addresses {
+		log.Debugf("sending SearchGatewayRequest to %s", address)
+		_, err := conn.WriteToUDP(createSearchGatewayRequest(), &net.UDPAddr{IP: address, Port: discoveryPort})
+		if err != nil {
+			log.Warnf("failed to send SearchGatewayRequest to %s: %v", address, err)
+		}
+	}
+
+	gateways := make(map[string]Gateway)
+	buf := make([]byte, 1024)
+	for {
+		select {
+		case <-ctx.Done():
+			return sortedGateways(gateways), nil
+		default:
+		}
+
+		// don't block for too long, so a cancelled context is noticed
+		readDeadline := time.Now().Add(100 * time.Millisecond)
+		if deadline.Before(readDeadline) {
+			readDeadline = deadline
+		}
+		err := conn.SetReadDeadline(readDeadline)
+		if err != nil {
+			log.Errorf("failed to set read deadline: %v", err)
+			return nil, errors.Wrap(err, "setting read deadline")
+		}
+
+		length, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			log.Errorf("failed to read response: %v", err)
+			return nil, errors.Wrap(err, "reading response")
+		}
+
+		gateway, err := parseSearchGatewayResponse(buf[:length])
+		if err != nil {
+			log.Debugf("ignoring invalid response from %s: %v", addr, err)
+			continue
+		}
+		log.Debugf("found gateway: %v", gateway)
+		gateways[hex.EncodeToString(gateway.UUID)] = gateway
+	}
+}
+
+func sortedGateways(gateways map[string]Gateway) []Gateway {
+	result := make([]Gateway, 0, len(gateways))
+	for _, gateway := range gateways {
+		result = append(result, gateway)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].IP < result[j].IP
+	})
+	return result
+}
@@ -0,0 +1,81 @@
+package comfoconnect
+
+import (
+	"sync"
+	"time"
+)
+
+const joulesPerKwh = 3.6e6
+
+// how far from the start of the year a year-to-date total going down counts as a rollover,
+// to allow for the clock of the device being off
+const rolloverWindow = 48 * time.Hour
+
+// the reasons a cumulative PDO can go down
+const (
+	ResetRollover = "rollover" // a year-to-date total that restarted around Jan 1st
+	ResetDevice   = "reset"    // a total that should never go down, so the device was reset
+)
+
+// EnergyIncrement is what a cumulative PDO increased with since it was last observed
+type EnergyIncrement struct {
+	Ppid   uint32
+	Joules float64
+	Reset  bool   // the total went down, Joules is the total since the reset
+	Reason string // ResetRollover or ResetDevice, when Reset is set
+}
+
+// EnergyCounters turns the totals of cumulative PDOs into increments, so they can be exported as counters.
+// When a total goes down, that's recorded as a reset instead of a negative increment.
+type EnergyCounters struct {
+	lock sync.Mutex
+	last map[uint32]float64 // the last total per ppid, in joules
+	now  func() time.Time
+}
+
+func NewEnergyCounters() *EnergyCounters {
+	return &EnergyCounters{last: make(map[uint32]float64), now: time.Now}
+}
+
+// Observe returns the increment of a cumulative PDO, false when the PDO isn't cumulative.
+// The first observation of a PDO returns its total.
+func (e *EnergyCounters) Observe(ppid uint32, conv RpdoTypeConverter) (EnergyIncrement, bool) {
+	definition, ok := GetCatalog().Get(ppid)
+	if !ok || definition.Cumulative == "" || conv.Validate() != nil {
+		return EnergyIncrement{}, false
+	}
+
+	total := conv.Tofloat64()
+	if definition.Unit == "kwh" {
+		total *= joulesPerKwh
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	increment := EnergyIncrement{Ppid: ppid, Joules: total}
+	last, seen := e.last[ppid]
+	e.last[ppid] = total
+	if !seen {
+		return increment, true
+	}
+
+	if total < last {
+		increment.Reset = true
+		increment.Reason = ResetDevice
+		if definition.Cumulative == CumulativeYear && nearNewYear(e.now()) {
+			increment.Reason = ResetRollover
+		}
+		return increment, true
+	}
+
+	increment.Joules = total - last
+	return increment, true
+}
+
+// nearNewYear returns whether `t` is within the rolloverWindow of a Jan 1st
+func nearNewYear(t time.Time) bool {
+	start := time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location())
+	next := start.AddDate(1, 0, 0)
+	return t.Sub(start) < rolloverWindow || next.Sub(t) < rolloverWindow
+}
@@ -0,0 +1,119 @@
+package comfoconnect
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// the field number of the reference in GatewayOperation
+const referenceFieldNumber = 4
+
+// Forward encodes the message to pass it on. For a received message, the received bytes are used, with only Src, Dst and
+// the reference replaced by the ones of the message. That way fields and operation types that aren't in zehnder.proto
+// are kept. Messages that weren't received are encoded like Encode does.
+func (m Message) Forward() []byte {
+	log := logrus.WithFields(logrus.Fields{
+		"module": "comfoconnect",
+		"object": "Message",
+		"method": "Forward",
+	})
+
+	if len(m.RawMessage) < 38 {
+		return m.Encode()
+	}
+	operationLength := int(binary.BigEndian.Uint16(m.RawMessage[36:38]))
+	if 38+operationLength > len(m.RawMessage) {
+		log.Warnf("invalid operation length %d, encoding instead", operationLength)
+		return m.Encode()
+	}
+
+	operation, err := setReference(m.RawMessage[38:38+operationLength], m.Operation.Reference)
+	if err != nil {
+		log.Warnf("failed to patch the reference, encoding instead: %v", err)
+		return m.Encode()
+	}
+	operationType := m.RawMessage[38+operationLength:]
+
+	src := m.RawMessage[4:20]
+	if len(m.Src) == 16 {
+		src = m.Src
+	}
+	dst := m.RawMessage[20:36]
+	if len(m.Dst) == 16 {
+		dst = m.Dst
+	}
+
+	result := make([]byte, 4, 38+len(operation)+len(operationType))
+	binary.BigEndian.PutUint32(result, uint32(34+len(operation)+len(operationType))) // raw message length
+	result = append(result, src...)
+	result = append(result, dst...)
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(len(operation))) // op length
+	result = append(result, b...)
+	result = append(result, operation...)
+	result = append(result, operationType...)
+	return result
+}
+
+// setReference replaces the reference in an encoded GatewayOperation, and keeps the other fields as they are.
+// A nil reference removes it.
+func setReference(operation []byte, reference *uint32) ([]byte, error) {
+	result := make([]byte, 0, len(operation)+5)
+	found := false
+	for i := 0; i < len(operation); {
+		start := i
+		tag, n := binary.Uvarint(operation[i:])
+		if n <= 0 {
+			return nil, errors.New(fmt.Sprintf("invalid tag at offset %d", i))
+		}
+		i += n
+
+		switch tag & 7 {
+		case 0: // varint
+			_, n := binary.Uvarint(operation[i:])
+			if n <= 0 {
+				return nil, errors.New(fmt.Sprintf("invalid varint at offset %d", i))
+			}
+			i += n
+		case 1: // 64-bit
+			i += 8
+		case 2: // length-delimited
+			length, n := binary.Uvarint(operation[i:])
+			if n <= 0 {
+				return nil, errors.New(fmt.Sprintf("invalid length at offset %d", i))
+			}
+			i += n + int(length)
+		case 5: // 32-bit
+			i += 4
+		default:
+			return nil, errors.New(fmt.Sprintf("unsupported wire type %d at offset %d", tag&7, start))
+		}
+		if i > len(operation) {
+			return nil, errors.New(fmt.Sprintf("field at offset %d is truncated", start))
+		}
+
+		if tag>>3 == referenceFieldNumber && tag&7 == 0 {
+			if !found && reference != nil {
+				result = appendReference(result, *reference)
+			}
+			found = true
+			continue
+		}
+		result = append(result, operation[start:i]...)
+	}
+
+	if !found && reference != nil {
+		result = appendReference(result, *reference)
+	}
+	return result, nil
+}
+
+func appendReference(b []byte, reference uint32) []byte {
+	b = append(b, referenceFieldNumber<<3)
+	varint := make([]byte, binary.MaxVarintLen32)
+	n := binary.PutUvarint(varint, uint64(reference))
+	return append(b, varint[:n]...)
+}
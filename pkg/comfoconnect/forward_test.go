@@ -0,0 +1,203 @@
+package comfoconnect
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hsmade/comfoconnectbridge/proto"
+)
+
+func uint32Pointer(v uint32) *uint32 {
+	return &v
+}
+
+func TestSetReference(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation []byte
+		reference *uint32
+		want      []byte
+		wantErr   bool
+	}{
+		{
+			name:      "replaces the reference",
+			operation: []byte{0x08, 0x21, 0x20, 0x07},
+			reference: uint32Pointer(300),
+			want:      []byte{0x08, 0x21, 0x20, 0xac, 0x02},
+		},
+		{
+			name:      "keeps the position of the reference",
+			operation: []byte{0x20, 0x07, 0x08, 0x21},
+			reference: uint32Pointer(8),
+			want:      []byte{0x20, 0x08, 0x08, 0x21},
+		},
+		{
+			name:      "adds a missing reference",
+			operation: []byte{0x08, 0x21},
+			reference: uint32Pointer(8),
+			want:      []byte{0x08, 0x21, 0x20, 0x08},
+		},
+		{
+			name:      "nil removes the reference",
+			operation: []byte{0x08, 0x21, 0x20, 0x07, 0x10, 0x00},
+			want:      []byte{0x08, 0x21, 0x10, 0x00},
+		},
+		{
+			name:      "a repeated reference is replaced once",
+			operation: []byte{0x20, 0x07, 0x08, 0x21, 0x20, 0x09},
+			reference: uint32Pointer(8),
+			want:      []byte{0x20, 0x08, 0x08, 0x21},
+		},
+		{
+			name: "keeps the other fields as they are",
+			operation: []byte{
+				0x08, 0x21, // type
+				0x1a, 0x01, 0x78, // resultDescription
+				0x78, 0x01, // unknown varint field 15
+				0x35, 0x01, 0x02, 0x03, 0x04, // unknown 32-bit field 6
+				0x39, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, // unknown 64-bit field 7
+				0x20, 0x07, // reference
+			},
+			reference: uint32Pointer(8),
+			want: []byte{
+				0x08, 0x21,
+				0x1a, 0x01, 0x78,
+				0x78, 0x01,
+				0x35, 0x01, 0x02, 0x03, 0x04,
+				0x39, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+				0x20, 0x08,
+			},
+		},
+		{
+			name:      "empty operation",
+			operation: []byte{},
+			reference: uint32Pointer(8),
+			want:      []byte{0x20, 0x08},
+		},
+		{
+			name:      "truncated varint",
+			operation: []byte{0x08, 0x21, 0x20, 0x80},
+			reference: uint32Pointer(8),
+			wantErr:   true,
+		},
+		{
+			name:      "truncated length-delimited field",
+			operation: []byte{0x1a, 0x05, 0x78},
+			reference: uint32Pointer(8),
+			wantErr:   true,
+		},
+		{
+			name:      "truncated 32-bit field",
+			operation: []byte{0x35, 0x01, 0x02},
+			reference: uint32Pointer(8),
+			wantErr:   true,
+		},
+		{
+			name:      "unsupported wire type",
+			operation: []byte{0x0b, 0x0c},
+			reference: uint32Pointer(8),
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := setReference(tt.operation, tt.reference)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %x, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForward(t *testing.T) {
+	operationType := proto.GatewayOperation_CnRmiRequestType
+	reference := uint32(7)
+	received := Message{
+		Src: bytes.Repeat([]byte{0x01}, 16),
+		Dst: bytes.Repeat([]byte{0x02}, 16),
+		Operation: proto.GatewayOperation{
+			Type:      &operationType,
+			Reference: &reference,
+		},
+		OperationType: &proto.CnRmiRequest{NodeId: uint32Pointer(1), Message: []byte{0x87, 0x15, 0x01}},
+	}
+	received.RawMessage = received.Encode()
+
+	tests := []struct {
+		name    string
+		message func() Message
+		wantSrc []byte
+		wantDst []byte
+		wantRef uint32
+	}{
+		{
+			name:    "unchanged",
+			message: func() Message { return received },
+			wantSrc: received.Src,
+			wantDst: received.Dst,
+			wantRef: 7,
+		},
+		{
+			name: "new addresses and reference",
+			message: func() Message {
+				m := received
+				m.Src = bytes.Repeat([]byte{0x03}, 16)
+				m.Dst = bytes.Repeat([]byte{0x04}, 16)
+				m.Operation.Reference = uint32Pointer(0x10000)
+				return m
+			},
+			wantSrc: bytes.Repeat([]byte{0x03}, 16),
+			wantDst: bytes.Repeat([]byte{0x04}, 16),
+			wantRef: 0x10000,
+		},
+		{
+			name: "invalid addresses keep the received ones",
+			message: func() Message {
+				m := received
+				m.Src = []byte{0x05}
+				m.Dst = nil
+				return m
+			},
+			wantSrc: received.Src,
+			wantDst: received.Dst,
+			wantRef: 7,
+		},
+		{
+			name: "not received is encoded",
+			message: func() Message {
+				m := received
+				m.RawMessage = nil
+				m.Operation.Reference = uint32Pointer(9)
+				return m
+			},
+			wantSrc: received.Src,
+			wantDst: received.Dst,
+			wantRef: 9,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := tt.message()
+			got := message.Forward()
+
+			want := message
+			want.Src = tt.wantSrc
+			want.Dst = tt.wantDst
+			want.Operation.Reference = &tt.wantRef
+			if wantBytes := want.Encode(); !bytes.Equal(got, wantBytes) {
+				t.Errorf("got %x, want %x", got, wantBytes)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package comfoconnect
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/hsmade/comfoconnectbridge/proto"
+)
+
+const (
+	defaultFupChunkSize = 256
+	fupTimeout          = 10 * time.Second
+)
+
+// ProgramOptions describes how a node firmware image is to be programmed
+type ProgramOptions struct {
+	Node      uint32
+	Block     uint32
+	ChunkSize int  // defaults to 256 bytes
+	DryRun    bool // only validate and plan, don't send anything to the node
+}
+
+// ProgramPlan is the result of (dry-)running a programming sequence
+type ProgramPlan struct {
+	Node      Node
+	Block     uint32
+	ImageSize int
+	Chunks    int
+	Executed  bool
+}
+
+func (p ProgramPlan) String() string {
+	return fmt.Sprintf("node=%d product=%d mode=%s block=%d size=%d chunks=%d executed=%v",
+		p.Node.ID, p.Node.ProductID, p.Node.Mode.String(), p.Block, p.ImageSize, p.Chunks, p.Executed)
+}
+
+// ProgramNode flashes `image` onto a node, using the CnFupProgramBegin/Program/End/Reset sequence.
+// It refuses to start unless the node inventory shows the node online, and in NODE_NORMAL or NODE_UPDATE mode.
+// When programming fails after it began, the node is reset so it doesn't stay in NODE_UPDATE with half an image.
+func (s *Session) ProgramNode(image []byte, options ProgramOptions) (plan ProgramPlan, err error) {
+	log := logrus.WithFields(logrus.Fields{
+		"module": "comfoconnect",
+		"object": "Session",
+		"method": "ProgramNode",
+		"node":   options.Node,
+		"dryRun": options.DryRun,
+	})
+
+	if options.ChunkSize <= 0 {
+		options.ChunkSize = defaultFupChunkSize
+	}
+	if len(image) == 0 {
+		return ProgramPlan{}, errors.New("refusing to program an empty image")
+	}
+
+	nodes, err := s.RefreshNodes(time.Second, options.Node)
+	if err != nil {
+		log.Errorf("failed to refresh node inventory: %v", err)
+		return ProgramPlan{}, errors.Wrap(err, "refreshing node inventory")
+	}
+
+	node, ok := nodes[options.Node]
+	if !ok {
+		return ProgramPlan{}, errors.New(fmt.Sprintf("node %d is not in the node inventory", options.Node))
+	}
+	if !node.Online() {
+		return ProgramPlan{}, errors.New(fmt.Sprintf("node %d is offline", options.Node))
+	}
+	if node.Mode != proto.CnNodeNotification_NODE_NORMAL && node.Mode != proto.CnNodeNotification_NODE_UPDATE {
+		return ProgramPlan{}, errors.New(fmt.Sprintf("node %d is in mode %s, refusing to program", options.Node, node.Mode.String()))
+	}
+
+	plan = ProgramPlan{
+		Node:      node,
+		Block:     options.Block,
+		ImageSize: len(image),
+		Chunks:    (len(image) + options.ChunkSize - 1) / options.ChunkSize,
+	}
+	if options.DryRun {
+		log.Infof("dry-run: %v", plan)
+		return plan, nil
+	}
+
+	log.Infof("starting programming: %v", plan)
+	_, err = s.Request(proto.GatewayOperation_CnFupProgramBeginRequestType, &proto.CnFupProgramBeginRequest{
+		Node:  []uint32{options.Node},
+		Block: &options.Block,
+	}, fupTimeout)
+	if err != nil {
+		log.Errorf("failed to begin programming: %v", err)
+		return plan, errors.Wrap(err, "beginning programming")
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		log.Warnf("programming failed, resetting node: %v", err)
+		_, resetErr := s.Request(proto.GatewayOperation_CnFupResetRequestType, &proto.CnFupResetRequest{
+			Node: &options.Node,
+		}, fupTimeout)
+		if resetErr != nil {
+			log.Errorf("failed to reset node after programming failed: %v", resetErr)
+		}
+	}()
+
+	for i := 0; i < plan.Chunks; i++ {
+		end := (i + 1) * options.ChunkSize
+		if end > len(image) {
+			end = len(image)
+		}
+		log.Debugf("sending chunk %d/%d", i+1, plan.Chunks)
+		_, err = s.Request(proto.GatewayOperation_CnFupProgramRequestType, &proto.CnFupProgramRequest{
+			Chunk: image[i*options.ChunkSize : end],
+		}, fupTimeout)
+		if err != nil {
+			log.Errorf("failed to program chunk %d: %v", i, err)
+			return plan, errors.Wrap(err, fmt.Sprintf("programming chunk %d", i))
+		}
+	}
+
+	_, err = s.Request(proto.GatewayOperation_CnFupProgramEndRequestType, &proto.CnFupProgramEndRequest{}, fupTimeout)
+	if err != nil {
+		log.Errorf("failed to end programming: %v", err)
+		return plan, errors.Wrap(err, "ending programming")
+	}
+
+	_, err = s.Request(proto.GatewayOperation_CnFupResetRequestType, &proto.CnFupResetRequest{
+		Node: &options.Node,
+	}, fupTimeout)
+	if err != nil {
+		log.Errorf("failed to reset node: %v", err)
+		return plan, errors.Wrap(err, "resetting node")
+	}
+
+	plan.Executed = true
+	log.Infof("programming done: %v", plan)
+	return plan, nil
+}
@@ -0,0 +1,64 @@
+package comfoconnect_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
+	"github.com/hsmade/comfoconnectbridge/proto"
+)
+
+func TestProgramNode(t *testing.T) {
+	_, session, stop := startMock(t)
+	defer stop()
+
+	image := bytes.Repeat([]byte{0xaa}, 600)
+	tests := []struct {
+		name         string
+		options      comfoconnect.ProgramOptions
+		wantErr      bool
+		wantExecuted bool
+	}{
+		{
+			name:    "dry-run",
+			options: comfoconnect.ProgramOptions{Node: 1, DryRun: true},
+		},
+		{
+			name:    "unknown node",
+			options: comfoconnect.ProgramOptions{Node: 2},
+			wantErr: true,
+		},
+		{
+			name:         "programs the node",
+			options:      comfoconnect.ProgramOptions{Node: 1},
+			wantExecuted: true,
+		},
+		{
+			name:    "chunk is refused",
+			options: comfoconnect.ProgramOptions{Node: 1, ChunkSize: 512}, // the mock takes up to 256 bytes
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := session.ProgramNode(image, tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want an error: %v", err, tt.wantErr)
+			}
+			if plan.Executed != tt.wantExecuted {
+				t.Errorf("executed is %v, want %v", plan.Executed, tt.wantExecuted)
+			}
+
+			// whatever happened, the node has to be out of update mode, and ready to be programmed again
+			nodes, err := session.RefreshNodes(time.Second, 1)
+			if err != nil {
+				t.Fatalf("refreshing nodes: %v", err)
+			}
+			if mode := nodes[1].Mode; mode != proto.CnNodeNotification_NODE_NORMAL {
+				t.Errorf("node is in mode %s, want NODE_NORMAL", mode)
+			}
+		})
+	}
+}
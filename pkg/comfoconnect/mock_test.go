@@ -0,0 +1,47 @@
+package comfoconnect_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
+	"github.com/hsmade/comfoconnectbridge/pkg/mockLanC"
+)
+
+// startMock starts the mock gateway on 127.0.0.1 and returns it with a session to it, stop them when done
+func startMock(t *testing.T) (*mockLanC.MockLanC, *comfoconnect.Session, func()) {
+	l, err := comfoconnect.NewBroadcastListener("127.0.0.1:56747", nil, []comfoconnect.Gateway{{
+		IP:   "127.0.0.1",
+		UUID: []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x25, 0x10, 0x10, 0x80, 0x01, 0xe2, 0x03, 0x56, 0x7c, 0x4d, 0x2c},
+	}})
+	if err != nil {
+		t.Fatalf("starting broadcast listener: %v", err)
+	}
+	go l.Run()
+	m := mockLanC.NewMockLanC("127.0.0.1", "")
+	go m.Run()
+
+	session, stopSession := connectMock(t)
+	return m, session, func() {
+		stopSession()
+		m.Stop()
+		l.Stop()
+	}
+}
+
+// connectMock starts a new session to the mock gateway, close it when done
+func connectMock(t *testing.T) (*comfoconnect.Session, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	session, err := comfoconnect.NewSession(ctx, &wg, "127.0.0.1", 0, nil)
+	if err != nil {
+		cancel()
+		t.Fatalf("connecting to the mock gateway: %v", err)
+	}
+	return session, func() {
+		session.Close()
+		cancel()
+		wg.Wait()
+	}
+}
@@ -1,22 +1,77 @@
 package comfoconnect
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 
-	"github.com/sirupsen/logrus"
+	"github.com/pkg/errors"
 )
 
+// PdoType is the ComfoNet data type of a PDO, as it is used in CnRpdoRequest.type.
+// All numeric types are little endian.
+type PdoType uint32
+
+const (
+	PdoTypeBool   PdoType = 0
+	PdoTypeUint8  PdoType = 1
+	PdoTypeUint16 PdoType = 2
+	PdoTypeUint32 PdoType = 3
+	PdoTypeInt8   PdoType = 5
+	PdoTypeInt16  PdoType = 6
+	PdoTypeInt64  PdoType = 8
+	PdoTypeRaw    PdoType = 9
+)
+
+// returns the number of bytes a PDO of this type has, or 0 when it has no fixed length
+func (t PdoType) length() int {
+	switch t {
+	case PdoTypeBool, PdoTypeUint8, PdoTypeInt8:
+		return 1
+	case PdoTypeUint16, PdoTypeInt16:
+		return 2
+	case PdoTypeUint32:
+		return 4
+	case PdoTypeInt64:
+		return 8
+	default:
+		return 0
+	}
+}
+
+// guess the type of an unknown PDO, by its length
+func pdoTypeForLength(length int) PdoType {
+	switch length {
+	case 1:
+		return PdoTypeUint8
+	case 2:
+		return PdoTypeUint16
+	case 4:
+		return PdoTypeUint32
+	case 8:
+		return PdoTypeInt64
+	default:
+		return PdoTypeRaw
+	}
+}
+
 type RpdoTypeConverter interface {
 	Tofloat64() float64
 	GetID() string
 	GetDescription() string
+	GetType() PdoType
+	GetRaw() []byte
+	Validate() error
+	GetState() (string, bool)
+	GetStates() []EnumValue
 }
 
 type rpdoType struct {
 	ID          uint32
 	Description string
+	Type        PdoType
+	Scale       float64     // the decoded value is multiplied by this, 0 means 1
+	Enum        []EnumValue // the symbolic values, in order, or nil when the PDO is numeric
+	rawValue    []byte
 }
 
 func (r rpdoType) GetDescription() string {
@@ -27,237 +82,207 @@ func (r rpdoType) GetID() string {
 	return fmt.Sprintf("%d", r.ID)
 }
 
+func (r rpdoType) GetType() PdoType {
+	return r.Type
+}
+
+func (r rpdoType) GetRaw() []byte {
+	return r.rawValue
+}
+
+// Validate checks that the raw value has the right length for the type
+func (r rpdoType) Validate() error {
+	length := r.Type.length()
+	if length > 0 && len(r.rawValue) != length {
+		return errors.New(fmt.Sprintf("ppid %d of type %d should have %d bytes, but got %d: %x", r.ID, r.Type, length, len(r.rawValue), r.rawValue))
+	}
+	return nil
+}
+
+// GetStates returns the ordered set of symbolic values the PDO can have, or nil when it is numeric
+func (r rpdoType) GetStates() []EnumValue {
+	return r.Enum
+}
+
+// GetState returns the name of the current value, false when the PDO is numeric or the value is unknown
+func (r rpdoType) GetState() (string, bool) {
+	if len(r.Enum) == 0 {
+		return "", false
+	}
+	value, err := r.integer()
+	if err != nil {
+		return "", false
+	}
+	for _, state := range r.Enum {
+		if state.Value == value {
+			return state.Name, true
+		}
+	}
+	return "", false
+}
+
+// returns the unscaled value as an integer
+func (r rpdoType) integer() (int64, error) {
+	err := r.Validate()
+	if err != nil {
+		return 0, err
+	}
+	switch r.Type {
+	case PdoTypeBool, PdoTypeUint8:
+		return int64(r.rawValue[0]), nil
+	case PdoTypeUint16:
+		return int64(binary.LittleEndian.Uint16(r.rawValue)), nil
+	case PdoTypeUint32:
+		return int64(binary.LittleEndian.Uint32(r.rawValue)), nil
+	case PdoTypeInt8:
+		return int64(int8(r.rawValue[0])), nil
+	case PdoTypeInt16:
+		return int64(int16(binary.LittleEndian.Uint16(r.rawValue))), nil
+	case PdoTypeInt64:
+		return int64(binary.LittleEndian.Uint64(r.rawValue)), nil
+	default:
+		return 0, errors.New(fmt.Sprintf("ppid %d of type %d has no integer value", r.ID, r.Type))
+	}
+}
+
+func (r rpdoType) scale(value float64) float64 {
+	if r.Scale == 0 {
+		return value
+	}
+	return value * r.Scale
+}
+
+// RpdoType0 is a boolean
 type RpdoType0 struct {
 	rpdoType
-	rawValue []byte
 }
 
 func (r RpdoType0) Tofloat64() float64 {
-	if r.rawValue == nil {
+	if r.Validate() != nil || r.rawValue[0] == 0 {
 		return 0
-	} else {
-		return 1
 	}
+	return 1
 }
 
+// RpdoType1 is an unsigned 8 bit integer
 type RpdoType1 struct {
 	rpdoType
-	rawValue []byte
 }
 
 func (r RpdoType1) Tofloat64() float64 {
-	value := int(r.rawValue[0])
-	if len(r.rawValue) > 1 {
-		value += int(r.rawValue[1]) * 256
+	if r.Validate() != nil {
+		return 0
 	}
-	return float64(value)
+	return r.scale(float64(r.rawValue[0]))
 }
 
+// RpdoType2 is an unsigned 16 bit integer
 type RpdoType2 struct {
 	rpdoType
-	rawValue []byte
 }
 
 func (r RpdoType2) Tofloat64() float64 {
-	return float64(binary.BigEndian.Uint16(r.rawValue))
+	if r.Validate() != nil {
+		return 0
+	}
+	return r.scale(float64(binary.LittleEndian.Uint16(r.rawValue)))
 }
 
+// RpdoType3 is an unsigned 32 bit integer
 type RpdoType3 struct {
 	rpdoType
-	rawValue []byte
 }
 
 func (r RpdoType3) Tofloat64() float64 {
-	return float64(binary.BigEndian.Uint32(r.rawValue))
+	if r.Validate() != nil {
+		return 0
+	}
+	return r.scale(float64(binary.LittleEndian.Uint32(r.rawValue)))
+}
+
+// RpdoType5 is a signed 8 bit integer
+type RpdoType5 struct {
+	rpdoType
 }
 
+func (r RpdoType5) Tofloat64() float64 {
+	if r.Validate() != nil {
+		return 0
+	}
+	return r.scale(float64(int8(r.rawValue[0])))
+}
+
+// RpdoType6 is a signed 16 bit integer
 type RpdoType6 struct {
 	rpdoType
-	rawValue []byte
 }
 
 func (r RpdoType6) Tofloat64() float64 {
-	var i int16
-	_ = binary.Read(bytes.NewReader(r.rawValue), binary.BigEndian, &i)
-	return float64(i)
+	if r.Validate() != nil {
+		return 0
+	}
+	return r.scale(float64(int16(binary.LittleEndian.Uint16(r.rawValue))))
 }
 
-func NewPpid(ppid uint32, data []byte) RpdoTypeConverter {
-	log := logrus.WithFields(logrus.Fields{
-		"module": "comfoconnect",
-		"method": "NewPpid",
-		"ppid":   ppid,
-	})
-
-	switch ppid {
-	case 16:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 33:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 37:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 42:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 49:
-		return RpdoType1{rpdoType{ppid, "Operating mode1"}, data}
-	case 53:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 56:
-		return RpdoType1{rpdoType{ppid, "Operating mode2"}, data}
-	case 57:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 58:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 65:
-		return RpdoType1{rpdoType{ppid, "Fans: Fan speed setting"}, data}
-	case 66:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 67:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 70:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 71:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 73:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 74:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 81:
-		return RpdoType3{rpdoType{ppid, "General: Countdown until next fan speed change"}, data}
-	case 82:
-		return RpdoType3{rpdoType{ppid, "Unknown"}, data}
-	case 85:
-		return RpdoType3{rpdoType{ppid, "Unknown"}, data}
-	case 86:
-		return RpdoType3{rpdoType{ppid, "Unknown"}, data}
-	case 87:
-		return RpdoType3{rpdoType{ppid, "Unknown"}, data}
-	case 89:
-		return RpdoType3{rpdoType{ppid, "Unknown"}, data}
-	case 90:
-		return RpdoType3{rpdoType{ppid, "Unknown"}, data}
-	case 117:
-		return RpdoType1{rpdoType{ppid, "Fans: Exhaust fan duty"}, data}
-	case 118:
-		return RpdoType1{rpdoType{ppid, "Fans: Supply fan duty"}, data}
-	case 119:
-		return RpdoType1{rpdoType{ppid, "Fans: Exhaust fan flow"}, data}
-	case 120:
-		return RpdoType1{rpdoType{ppid, "Fans: Supply fan flow"}, data}
-	case 121:
-		return RpdoType1{rpdoType{ppid, "Fans: Exhaust fan speed"}, data}
-	case 122:
-		return RpdoType1{rpdoType{ppid, "Fans: Supply fan speed"}, data}
-	case 128:
-		return RpdoType1{rpdoType{ppid, "Power Consumption: Current Ventilation"}, data}
-	case 129:
-		return RpdoType1{rpdoType{ppid, "Power Consumption: Total year-to-date"}, data}
-	case 130:
-		return RpdoType1{rpdoType{ppid, "Power Consumption: Total from start"}, data}
-	case 144:
-		return RpdoType1{rpdoType{ppid, "Preheater Power Consumption: Total year-to-date"}, data}
-	case 145:
-		return RpdoType1{rpdoType{ppid, "Preheater Power Consumption: Total from start"}, data}
-	case 146:
-		return RpdoType1{rpdoType{ppid, "Preheater Power Consumption: Current Ventilation"}, data}
-	case 176:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 192:
-		return RpdoType1{rpdoType{ppid, "Days left before filters must be replaced"}, data}
-	case 208:
-		return RpdoType1{rpdoType{ppid, "Unknown temperature"}, data}
-	case 209:
-		return RpdoType1{rpdoType{ppid, "Current RMOT"}, data}
-	case 210:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 211:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 212:
-		return RpdoType1{rpdoType{ppid, "Temperature profile: cool"}, data}
-	case 213:
-		return RpdoType1{rpdoType{ppid, "Avoided Heating: Avoided actual"}, data}
-	case 214:
-		return RpdoType1{rpdoType{ppid, "Avoided Heating: Avoided year-to-date"}, data}
-	case 215:
-		return RpdoType1{rpdoType{ppid, "Avoided Heating: Avoided total"}, data}
-	case 216:
-		return RpdoType1{rpdoType{ppid, "Avoided Cooling: Avoided actual"}, data}
-	case 217:
-		return RpdoType1{rpdoType{ppid, "Avoided Cooling: Avoided year-to-date"}, data}
-	case 218:
-		return RpdoType1{rpdoType{ppid, "Avoided Cooling: Avoided total"}, data}
-	case 219:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 220:
-		return RpdoType1{rpdoType{ppid, "Temperature: Outdoor Air"}, data}
-	case 221:
-		return RpdoType1{rpdoType{ppid, "Temperature: Supply Air"}, data}
-	case 224:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 225:
-		return RpdoType1{rpdoType{ppid, "Unknown: switches with fan"}, data}
-	case 226:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 227:
-		return RpdoType1{rpdoType{ppid, "Bypass state"}, data}
-	case 228:
-		return RpdoType1{rpdoType{ppid, "Unknown Frost Protection Unbalance"}, data}
-	case 274:
-		return RpdoType1{rpdoType{ppid, "Temperature: Extract Air"}, data}
-	case 275:
-		return RpdoType1{rpdoType{ppid, "Temperature: Exhaust Air"}, data}
-	case 276:
-		return RpdoType1{rpdoType{ppid, "Temperature: Outdoor Air"}, data}
-	case 278:
-		return RpdoType6{rpdoType{ppid, "PostHeaterTempBefore"}, data}
-	case 290:
-		return RpdoType1{rpdoType{ppid, "Humidity: Extract Air"}, data}
-	case 291:
-		return RpdoType1{rpdoType{ppid, "Humidity: Exhaust Air"}, data}
-	case 292:
-		return RpdoType1{rpdoType{ppid, "Humidity: Outdoor Air"}, data}
-	case 294:
-		return RpdoType1{rpdoType{ppid, "Humidity: Supply Air"}, data}
-	case 321:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 325:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 337:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 338:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 341:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 369:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 370:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 371:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 372:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 384:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 386:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 400:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 401:
-		return RpdoType1{rpdoType{ppid, "Unknown"}, data}
-	case 402:
-		return RpdoType0{rpdoType{ppid, "Unknown Post Heater Present"}, data}
-	case 416:
-		return RpdoType6{rpdoType{ppid, "unknown Outdoor air temperature"}, data}
-	case 417:
-		return RpdoType6{rpdoType{ppid, "unknown GHE Ground temperature"}, data}
-	case 418:
-		return RpdoType1{rpdoType{ppid, "unknown GHE State"}, data}
-	case 419:
-		return RpdoType0{rpdoType{ppid, "unknown GHE Present"}, data}
-	case 785:
-		return RpdoType0{rpdoType{ppid, "ComfoCoolCompressor State"}, data}
+// RpdoType8 is a signed 64 bit integer
+type RpdoType8 struct {
+	rpdoType
+}
+
+func (r RpdoType8) Tofloat64() float64 {
+	if r.Validate() != nil {
+		return 0
+	}
+	return r.scale(float64(int64(binary.LittleEndian.Uint64(r.rawValue))))
+}
+
+// RpdoType9 has no numeric value, use GetRaw() to get to the bytes
+type RpdoType9 struct {
+	rpdoType
+}
+
+func (r RpdoType9) Tofloat64() float64 {
+	return 0
+}
+
+// NewRpdo creates the decoder for a PDO of type `pdoType`
+func NewRpdo(ppid uint32, pdoType PdoType, description string, scale float64, data []byte) RpdoTypeConverter {
+	return newRpdo(PdoDefinition{ID: ppid, Name: description, Type: pdoType, Scale: scale}, data)
+}
+
+func newRpdo(definition PdoDefinition, data []byte) RpdoTypeConverter {
+	pdoType := definition.Type
+	r := rpdoType{
+		ID:          definition.ID,
+		Description: definition.Name,
+		Type:        pdoType,
+		Scale:       definition.Scale,
+		Enum:        definition.Enum,
+		rawValue:    data,
+	}
+
+	switch pdoType {
+	case PdoTypeBool:
+		return RpdoType0{r}
+	case PdoTypeUint8:
+		return RpdoType1{r}
+	case PdoTypeUint16:
+		return RpdoType2{r}
+	case PdoTypeUint32:
+		return RpdoType3{r}
+	case PdoTypeInt8:
+		return RpdoType5{r}
+	case PdoTypeInt16:
+		return RpdoType6{r}
+	case PdoTypeInt64:
+		return RpdoType8{r}
 	default:
-		log.Errorf(fmt.Sprintf("unable to decode Rpdo with ppid: %d", ppid))
-		return RpdoType1{rpdoType{ppid, "unknown"}, data}
+		r.Type = PdoTypeRaw
+		return RpdoType9{r}
 	}
 }
+
+// NewPpid creates the decoder for a PDO, as it is defined in the current catalog
+func NewPpid(ppid uint32, data []byte) RpdoTypeConverter {
+	return GetCatalog().Decode(ppid, data)
+}
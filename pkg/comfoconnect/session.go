@@ -3,7 +3,6 @@ package comfoconnect
 import (
 	"context"
 	"fmt"
-	"io"
 	"net"
 	"sync"
 	"time"
@@ -21,6 +20,51 @@ type Session struct {
 	Src  []byte
 	Dst  []byte
 	Conn net.Conn
+
+	// State holds the latest value of every PDO received through this session.
+	// It can be replaced before receiving, to keep the state when reconnecting.
+	State *StateStore
+
+	lock      sync.Mutex
+	reference uint32
+	nodes     map[uint32]Node
+
+	subscriptionLock sync.Mutex
+	subscriptions    map[uint32]*subscription
+
+	receiveLock sync.Mutex              // one reader of Conn at a time
+	waiters     map[uint32]chan Message // the references Request is waiting for, under lock
+	received    []Message               // read by Request or RefreshNodes, but not for them. Returned by Receive, under lock
+
+	closed    chan bool // closed by Close, to stop the keep-alive loop
+	closeOnce sync.Once
+
+	lastReceived time.Time // when the last message was read from the gateway, under lock
+	lastRead     time.Time // when a message was last waited for, under lock
+	lost         error     // why the session was given up, under lock
+}
+
+const (
+	keepAliveInterval = 5 * time.Second
+	// when nothing, not even the confirm of a keep-alive, was received for this long while reading, the link is lost
+	keepAliveTimeout = 3 * keepAliveInterval
+)
+
+// ErrSessionLost is the cause of the errors of Receive once the gateway stopped answering
+var ErrSessionLost = errors.New("session with the gateway was lost")
+
+// Node is the last known state of a ComfoNet node, as announced by the gateway through CnNodeNotification
+type Node struct {
+	ID        uint32
+	ProductID uint32
+	ZoneID    uint32
+	Mode      proto.CnNodeNotification_NodeModeType
+	LastSeen  time.Time
+}
+
+// Online returns true when the node is known and not reported as offline
+func (n Node) Online() bool {
+	return n.Mode != proto.CnNodeNotification_NODE_OFFLINE
 }
 
 func NewSession(ctx context.Context, wg *sync.WaitGroup, comfoConnectIP string, pin uint32, src []byte) (*Session, error) {
@@ -42,7 +86,7 @@ func NewSession(ctx context.Context, wg *sync.WaitGroup, comfoConnectIP string,
 	if src == nil {
 		// create our UUID
 		id := uuid.New()
-		src = append(make([]byte, 16), id[:]...)
+		src = append(make([]byte, 0, 16), id[:]...)
 	}
 
 	log.Debugf("set src=%x and dst=%x", src, dst)
@@ -121,10 +165,16 @@ func NewSession(ctx context.Context, wg *sync.WaitGroup, comfoConnectIP string,
 	}
 
 	s := Session{
-		IP:   comfoConnectIP,
-		Src:  src,
-		Dst:  dst,
-		Conn: conn,
+		IP:        comfoConnectIP,
+		Src:       src,
+		Dst:       dst,
+		Conn:      conn,
+		State:     NewStateStore(),
+		reference: reference,
+		nodes:     make(map[uint32]Node),
+		closed:    make(chan bool),
+
+		lastReceived: time.Now(),
 	}
 
 	log.Debug("starting keep-alive loop")
@@ -140,15 +190,25 @@ func (s *Session) keepAlive(ctx context.Context, wg *sync.WaitGroup) {
 		"method": "keepAlive",
 	})
 
-	ticker := time.NewTicker(5 * time.Second)
-	reference := uint32(50)
+	defer wg.Done()
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
-			wg.Done()
+			return
+		case <-s.closed:
+			log.Debug("session closed, stopping keepalives")
 			return
 		case <-ticker.C:
+			if silent := s.silence(); silent > keepAliveTimeout {
+				s.lose(fmt.Sprintf("nothing received from the gateway for %s", silent.Round(time.Second)))
+				return
+			}
+			s.retrySubscriptions()
+
 			log.Debug("sending keep alive")
+			reference := s.nextReference()
 			operationType := proto.GatewayOperation_CnTimeRequestType
 			m := Message{
 				Src: s.Src,
@@ -161,90 +221,355 @@ func (s *Session) keepAlive(ctx context.Context, wg *sync.WaitGroup) {
 			}
 			_, err := s.Conn.Write(m.Encode())
 			if err != nil {
-				if errors.Cause(err) == io.EOF {
-					log.Debug("Connection closed, stopping keepalives")
-					return
-				}
-				log.Errorf("keepalive got error: %v", err)
-			}
-			reference++
-			if reference > 1024 {
-				reference = 1
+				s.lose(fmt.Sprintf("sending keep alive: %v", err))
+				return
 			}
 		}
 	}
 }
 
-// send a UDP packet to `ip` and expect a searchGatewayResponse with the uuid
-func DiscoverGateway(ip string) (uuid []byte, err error) {
+func (s *Session) Close() {
 	log := logrus.WithFields(logrus.Fields{
 		"module": "comfoconnect",
-		"method": "DiscoverGateway",
+		"object": "Session",
+		"method": "Close",
+	})
+	// send a start session request
+	defer s.Conn.Close()
+	s.closeOnce.Do(func() {
+		if s.closed != nil {
+			close(s.closed)
+		}
 	})
 
-	raddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:56747", ip))
-	if err != nil {
-		log.Errorf("could not resolve gateway address %s: %v", ip, err)
-		return nil, errors.Wrap(err, fmt.Sprintf("resolving gateway address: %s", ip))
+	log.Debug("sending CloseSessionRequest")
+	reference := uint32(1)
+	operationType := proto.GatewayOperation_CloseSessionRequestType
+	_, _ = s.Conn.Write(Message{
+		Src: s.Src,
+		Dst: s.Dst,
+		Operation: proto.GatewayOperation{
+			Type:      &operationType,
+			Reference: &reference,
+		},
+		OperationType: &proto.CloseSessionRequest{},
+	}.Encode())
+}
+
+// the number of messages kept for Receive while nobody calls it, the oldest are dropped
+const maxReceived = 500
+
+// Receive returns the next message from the gateway. Messages that Request or RefreshNodes read while waiting, that
+// weren't for them, are returned first. A confirm that a Request is waiting for is passed to it as well.
+func (s *Session) Receive() (Message, error) {
+	s.lock.Lock()
+	if len(s.received) > 0 {
+		m := s.received[0]
+		s.received = s.received[1:]
+		s.lock.Unlock()
+		return m, nil
+	}
+	s.lock.Unlock()
+
+	m, err := s.read()
+	if err == nil {
+		s.deliver(m)
 	}
+	return m, err
+}
 
-	conn, err := net.DialUDP("udp", nil, raddr)
+// read reads a message from the gateway, and keeps the session state up to date with it
+func (s *Session) read() (Message, error) {
+	s.receiveLock.Lock()
+	defer s.receiveLock.Unlock()
+	s.lock.Lock()
+	s.lastRead = time.Now()
+	s.lock.Unlock()
+	s.Conn.SetReadDeadline(time.Now().Add(time.Millisecond * 300))
+	m, err := GetMessageFromSocket(s.Conn)
 	if err != nil {
-		log.Errorf("could not connect to gateway address %s: %v", ip, err)
-		return nil, errors.Wrap(err, fmt.Sprintf("connectinng to gateway address: %s", ip))
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.lost != nil {
+			return m, s.lost
+		}
+		return m, err
 	}
-	defer conn.Close()
+	s.lock.Lock()
+	s.lastReceived = time.Now()
+	s.lock.Unlock()
 
-	//conn.SetReadDeadline(time.Time{})
+	s.track(m)
+	s.trackSubscription(m)
+	if s.State != nil {
+		s.State.Update(m)
+	}
+	return m, nil
+}
 
-	_, err = conn.Write([]byte{0x0a, 0x00}) // wake up gateway
-	if err != nil {
-		log.Errorf("could write discovery packet to gateway address %s: %v", ip, err)
-		return nil, errors.Wrap(err, fmt.Sprintf("writing discovery packet to gateway address: %s", ip))
+// silence returns how long messages were waited for without receiving any. When nobody reads, that isn't counted,
+// as the messages are still waiting in the socket.
+func (s *Session) silence() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lastRead.Sub(s.lastReceived)
+}
+
+// lose gives up the session, by closing the connection so readers return ErrSessionLost
+func (s *Session) lose(reason string) {
+	select {
+	case <-s.closed:
+		return // closed on purpose
+	default:
 	}
+	logrus.WithFields(logrus.Fields{
+		"module": "comfoconnect",
+		"object": "Session",
+		"method": "lose",
+	}).Warnf("giving up the session with %s: %s", s.IP, reason)
 
-	buf := make([]byte, 1024)
-	_, err = conn.Read(buf)
-	if err != nil {
-		log.Errorf("could read message from gateway address %s: %v", ip, err)
-		return nil, errors.Wrap(err, fmt.Sprintf("reading message from gateway address: %s", ip))
+	s.lock.Lock()
+	s.lost = errors.Wrap(ErrSessionLost, reason)
+	s.lock.Unlock()
+	s.Conn.Close()
+}
+
+// deliver passes a confirm to the Request that waits for it, and returns false when nobody waits for it
+func (s *Session) deliver(m Message) bool {
+	if m.Operation.Reference == nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	waiter, ok := s.waiters[m.Operation.GetReference()]
+	if !ok {
+		return false
 	}
-	response := proto.SearchGatewayResponse{}
-	err = response.XXX_Unmarshal(buf[2:])
-	//if err != nil {
-	//	return nil, errors.Wrap(err, fmt.Sprintf("marshalling message from gateway address: %s", ip))
-	//}
+	select {
+	case waiter <- m:
+	default: // the waiter already has its confirm
+	}
+	return true
+}
 
-	return response.Uuid, nil
+// keep a message that was read while waiting for something else, for Receive
+func (s *Session) keep(m Message) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.received) >= maxReceived {
+		logrus.WithFields(logrus.Fields{
+			"module": "comfoconnect",
+			"object": "Session",
+			"method": "keep",
+		}).Warnf("nobody receives the messages of the gateway, dropping %v", s.received[0])
+		s.received = s.received[1:]
+	}
+	s.received = append(s.received, m)
 }
 
-func (s *Session) Close() {
+// keep the session state up to date with what passes by
+func (s *Session) track(m Message) {
+	if m.Operation.Type == nil || m.Operation.Type.String() != "CnNodeNotificationType" {
+		return
+	}
+	notification := m.OperationType.(*proto.CnNodeNotification)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.nodes == nil {
+		s.nodes = make(map[uint32]Node)
+	}
+	s.nodes[notification.GetNodeId()] = Node{
+		ID:        notification.GetNodeId(),
+		ProductID: notification.GetProductId(),
+		ZoneID:    notification.GetZoneId(),
+		Mode:      notification.GetMode(),
+		LastSeen:  time.Now(),
+	}
+}
+
+func (s *Session) nextReference() uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.reference++
+	if s.reference > 1024 {
+		s.reference = 1
+	}
+	return s.reference
+}
+
+// Nodes returns the node inventory as it is currently known to the session
+func (s *Session) Nodes() map[uint32]Node {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	nodes := make(map[uint32]Node, len(s.nodes))
+	for id, node := range s.nodes {
+		nodes[id] = node
+	}
+	return nodes
+}
+
+// RefreshNodes sends a CnNodeRequest and collects the CnNodeNotifications that come back, until all `expected` nodes
+// answered or `timeout` passed. Without expected nodes it waits for the whole timeout.
+func (s *Session) RefreshNodes(timeout time.Duration, expected ...uint32) (map[uint32]Node, error) {
 	log := logrus.WithFields(logrus.Fields{
 		"module": "comfoconnect",
 		"object": "Session",
-		"method": "Close",
+		"method": "RefreshNodes",
 	})
-	// send a start session request
-	defer s.Conn.Close()
 
-	log.Debug("sending CloseSessionRequest")
-	reference := uint32(1)
-	operationType := proto.GatewayOperation_CloseSessionRequestType
-	_, _ = s.Conn.Write(Message{
+	reference := s.nextReference()
+	operationType := proto.GatewayOperation_CnNodeRequestType
+	err := s.Send(Message{
 		Src: s.Src,
 		Dst: s.Dst,
 		Operation: proto.GatewayOperation{
 			Type:      &operationType,
 			Reference: &reference,
 		},
-		OperationType: &proto.CloseSessionRequest{},
-	}.Encode())
+		OperationType: &proto.CnNodeRequest{},
+		Span:          opentracing.StartSpan("comfoconnect.Session.RefreshNodes"),
+	})
+	if err != nil {
+		log.Errorf("failed to send CnNodeRequest: %v", err)
+		return nil, errors.Wrap(err, "sending CnNodeRequest")
+	}
+
+	start := time.Now()
+	deadline := start.Add(timeout)
+	for time.Now().Before(deadline) {
+		if len(expected) > 0 && s.seenSince(start, expected) {
+			break
+		}
+		m, err := s.read()
+		if err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			log.Errorf("failed to receive CnNodeNotification: %v", err)
+			return nil, errors.Wrap(err, "receiving CnNodeNotification")
+		}
+		if !s.deliver(m) {
+			s.keep(m)
+		}
+	}
+	return s.Nodes(), nil
 }
 
-func (s *Session) Receive() (Message, error) {
-	s.Conn.SetReadDeadline(time.Now().Add(time.Millisecond * 300))
-	m, err := GetMessageFromSocket(s.Conn)
-	return m, err
+// seenSince returns true when all `nodes` sent a CnNodeNotification since `start`
+func (s *Session) seenSince(start time.Time, nodes []uint32) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, id := range nodes {
+		if node, ok := s.nodes[id]; !ok || node.LastSeen.Before(start) {
+			return false
+		}
+	}
+	return true
+}
+
+// Request sends `request` to the gateway and waits for the confirm with the same reference.
+// Messages that arrive in the meantime are kept for Receive, so it can be used next to a receive loop.
+func (s *Session) Request(operationType proto.GatewayOperation_OperationType, request OperationType, timeout time.Duration) (Message, error) {
+	log := logrus.WithFields(logrus.Fields{
+		"module":        "comfoconnect",
+		"object":        "Session",
+		"method":        "Request",
+		"operationType": operationType.String(),
+	})
+
+	span := opentracing.StartSpan("comfoconnect.Session.Request")
+	defer span.Finish()
+
+	reference := s.nextReference()
+	waiter := make(chan Message, 1)
+	s.lock.Lock()
+	if s.waiters == nil {
+		s.waiters = make(map[uint32]chan Message)
+	}
+	s.waiters[reference] = waiter
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.waiters, reference)
+		s.lock.Unlock()
+	}()
+
+	err := s.Send(Message{
+		Src: s.Src,
+		Dst: s.Dst,
+		Operation: proto.GatewayOperation{
+			Type:      &operationType,
+			Reference: &reference,
+		},
+		OperationType: request,
+		Span:          span,
+	})
+	if err != nil {
+		log.Errorf("failed to send request: %v", err)
+		span.SetTag("err", err)
+		return Message{}, errors.Wrap(err, fmt.Sprintf("sending %s", operationType.String()))
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		var m Message
+		select {
+		case m = <-waiter:
+		default:
+			// read ourselves, a receive loop may pass the confirm through the waiter instead
+			read, err := s.read()
+			if err != nil {
+				if isTimeout(err) {
+					continue
+				}
+				log.Errorf("failed to receive confirm: %v", err)
+				span.SetTag("err", err)
+				return Message{}, errors.Wrap(err, fmt.Sprintf("receiving confirm for %s", operationType.String()))
+			}
+			if !s.deliver(read) {
+				log.Debugf("keeping message for Receive while waiting for confirm: %v", read)
+				s.keep(read)
+			}
+			continue
+		}
+		if m.Operation.Result != nil && m.Operation.GetResult() != proto.GatewayOperation_OK {
+			err := errors.New(fmt.Sprintf("gateway returned %s for %s", m.Operation.GetResult().String(), operationType.String()))
+			log.Error(err)
+			span.SetTag("err", err)
+			return m, err
+		}
+		return m, nil
+	}
+
+	err = errors.New(fmt.Sprintf("timeout while waiting for confirm for %s", operationType.String()))
+	log.Error(err)
+	span.SetTag("err", err)
+	return Message{}, err
+}
+
+func isTimeout(err error) bool {
+	if netErr, ok := errors.Cause(err).(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	return false
+}
+
+// Forward sends a message that was received from somewhere else, see Message.Forward
+func (s *Session) Forward(message Message) error {
+	log := logrus.WithFields(logrus.Fields{
+		"module": "comfoconnect",
+		"object": "Session",
+		"method": "Forward",
+	})
+	span := opentracing.GlobalTracer().StartSpan("comfoconnect.Session.Forward", opentracing.ChildOf(message.Span.Context()))
+	defer span.Finish()
+	SpanSetMessage(span, message)
+	b := message.Forward()
+	length, err := s.Conn.Write(b)
+	log.Infof("Wrote %d bytes to gateway. err:%v bytes:%x message:%v", length, err, b, message)
+	span.SetTag("written", length)
+	return err
 }
 
 func (s *Session) Send(message Message) error {
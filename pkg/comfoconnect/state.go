@@ -0,0 +1,231 @@
+package comfoconnect
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hsmade/comfoconnectbridge/proto"
+)
+
+// PdoState is the latest known value of a PDO
+type PdoState struct {
+	Ppid     uint32
+	Value    RpdoTypeConverter
+	Received time.Time // when the last notification was received
+	Changed  time.Time // when the value last changed
+}
+
+// Alarm is the last CnAlarmNotification of a node
+type Alarm struct {
+	NodeID       uint32    `json:"node_id"`
+	ErrorID      uint32    `json:"error_id"`
+	Errors       []byte    `json:"errors"`
+	SerialNumber string    `json:"serial_number,omitempty"`
+	Received     time.Time `json:"received"`
+}
+
+// StateFilter selects the states a watcher is interested in
+type StateFilter func(state PdoState) bool
+
+// PpidFilter matches the states of the given PDOs
+func PpidFilter(ppids ...uint32) StateFilter {
+	wanted := make(map[uint32]bool, len(ppids))
+	for _, ppid := range ppids {
+		wanted[ppid] = true
+	}
+	return func(state PdoState) bool {
+		return wanted[state.Ppid]
+	}
+}
+
+// CategoryFilter matches the states of PDOs that are in one of the categories of the current catalog
+func CategoryFilter(categories ...string) StateFilter {
+	wanted := make(map[string]bool, len(categories))
+	for _, category := range categories {
+		wanted[category] = true
+	}
+	return func(state PdoState) bool {
+		definition, ok := GetCatalog().Get(state.Ppid)
+		return ok && wanted[definition.Category]
+	}
+}
+
+type stateWatcher struct {
+	filter  StateFilter
+	changes chan PdoState
+}
+
+// StateStore holds the latest value of every PDO that was received, and notifies watchers when a value changes
+type StateStore struct {
+	lock     sync.RWMutex
+	states   map[uint32]PdoState
+	alarms   map[uint32]Alarm
+	watchers map[int]*stateWatcher
+	nextID   int
+}
+
+func NewStateStore() *StateStore {
+	return &StateStore{
+		states:   make(map[uint32]PdoState),
+		alarms:   make(map[uint32]Alarm),
+		watchers: make(map[int]*stateWatcher),
+	}
+}
+
+// Update stores the value of a CnRpdoNotification or the alarm of a CnAlarmNotification,
+// other messages and invalid values are ignored. Returns true when a PDO value changed.
+func (s *StateStore) Update(m Message) bool {
+	if m.Operation.Type == nil {
+		return false
+	}
+	switch m.Operation.Type.String() {
+	case "CnRpdoNotificationType":
+		return s.updatePdo(m)
+	case "CnAlarmNotificationType":
+		if notification, ok := m.OperationType.(*proto.CnAlarmNotification); ok {
+			s.setAlarm(notification, time.Now())
+		}
+	}
+	return false
+}
+
+func (s *StateStore) updatePdo(m Message) bool {
+	notification, ok := m.OperationType.(*proto.CnRpdoNotification)
+	if !ok {
+		return false
+	}
+	conv := m.DecodePDO()
+	if err := conv.Validate(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"module": "comfoconnect",
+			"object": "StateStore",
+			"method": "updatePdo",
+		}).Warnf("ignoring invalid RPDO: %v", err)
+		return false
+	}
+	return s.Set(notification.GetPdid(), conv, time.Now())
+}
+
+// Set stores the value of a PDO, as it was received at `received`. Returns true when the value changed.
+func (s *StateStore) Set(ppid uint32, value RpdoTypeConverter, received time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	previous, known := s.states[ppid]
+	state := PdoState{
+		Ppid:     ppid,
+		Value:    value,
+		Received: received,
+		Changed:  received,
+	}
+	changed := !known || !bytes.Equal(previous.Value.GetRaw(), value.GetRaw())
+	if !changed {
+		state.Changed = previous.Changed
+	}
+	s.states[ppid] = state
+
+	if changed {
+		s.notify(state)
+	}
+	return changed
+}
+
+func (s *StateStore) setAlarm(notification *proto.CnAlarmNotification, received time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.alarms[notification.GetNodeId()] = Alarm{
+		NodeID:       notification.GetNodeId(),
+		ErrorID:      notification.GetErrorId(),
+		Errors:       notification.GetErrors(),
+		SerialNumber: notification.GetSerialNumber(),
+		Received:     received,
+	}
+}
+
+// Alarms returns the last alarm of every node that reported one, sorted by node
+func (s *StateStore) Alarms() []Alarm {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	result := make([]Alarm, 0, len(s.alarms))
+	for _, alarm := range s.alarms {
+		result = append(result, alarm)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].NodeID < result[j].NodeID
+	})
+	return result
+}
+
+// must be called with the lock held
+func (s *StateStore) notify(state PdoState) {
+	for id, watcher := range s.watchers {
+		if watcher.filter != nil && !watcher.filter(state) {
+			continue
+		}
+		select {
+		case watcher.changes <- state:
+		default:
+			logrus.WithFields(logrus.Fields{
+				"module":  "comfoconnect",
+				"object":  "StateStore",
+				"method":  "notify",
+				"watcher": id,
+			}).Warnf("watcher is not keeping up, dropping change of ppid %d", state.Ppid)
+		}
+	}
+}
+
+// Get returns the latest state of a PDO
+func (s *StateStore) Get(ppid uint32) (PdoState, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	state, ok := s.states[ppid]
+	return state, ok
+}
+
+// All returns the latest state of all PDOs, sorted by ppid
+func (s *StateStore) All() []PdoState {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	result := make([]PdoState, 0, len(s.states))
+	for _, state := range s.states {
+		result = append(result, state)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Ppid < result[j].Ppid
+	})
+	return result
+}
+
+// Watch returns a channel that receives the states that change and match `filter` (everything when nil).
+// Changes are dropped when the channel buffer of size `buffer` is full.
+// The returned function stops the watcher and closes the channel.
+func (s *StateStore) Watch(filter StateFilter, buffer int) (<-chan PdoState, func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	id := s.nextID
+	s.nextID++
+	watcher := stateWatcher{
+		filter:  filter,
+		changes: make(chan PdoState, buffer),
+	}
+	s.watchers[id] = &watcher
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			delete(s.watchers, id)
+			close(watcher.changes)
+		})
+	}
+	return watcher.changes, stop
+}
@@ -0,0 +1,356 @@
+package comfoconnect
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/hsmade/comfoconnectbridge/proto"
+)
+
+const (
+	// RpdoTimeoutNever is the default timeout of a CnRpdoRequest, the gateway keeps sending updates while the session lasts
+	RpdoTimeoutNever = math.MaxUint32
+
+	// how long to wait for a CnRpdoConfirm before the request is sent again
+	subscriptionRetryInterval = 5 * time.Second
+)
+
+// Subscription asks the gateway for updates of a PDO
+type Subscription struct {
+	Ppid    uint32
+	Type    PdoType
+	Timeout uint32 // the timeout field of the CnRpdoRequest, 0 means RpdoTimeoutNever
+}
+
+// SubscriptionStatus is the state of a subscription, as it is known to the session
+type SubscriptionStatus struct {
+	Subscription
+	Consumers []string
+	Confirmed bool
+	Attempts  int
+}
+
+type subscription struct {
+	ppid      uint32
+	pdoType   PdoType
+	consumers map[string]uint32 // the timeout each consumer asked for
+	timeout   uint32            // the timeout that was sent to the gateway
+	confirmed bool
+	reference uint32 // of the request that is waiting for a confirm, 0 when there is none
+	sentAt    time.Time
+	attempts  int
+}
+
+// the timeout to request, the longest one any consumer asked for
+func (s *subscription) effectiveTimeout() uint32 {
+	var timeout uint32
+	for _, t := range s.consumers {
+		if t > timeout {
+			timeout = t
+		}
+	}
+	return timeout
+}
+
+func (s *subscription) status() SubscriptionStatus {
+	status := SubscriptionStatus{
+		Subscription: Subscription{Ppid: s.ppid, Type: s.pdoType, Timeout: s.effectiveTimeout()},
+		Confirmed:    s.confirmed,
+		Attempts:     s.attempts,
+	}
+	for consumer := range s.consumers {
+		status.Consumers = append(status.Consumers, consumer)
+	}
+	sort.Strings(status.Consumers)
+	return status
+}
+
+// Subscribe requests updates for the PDOs on behalf of `consumer`.
+// Subscriptions are reference counted per consumer, so a CnRpdoRequest is only sent for PDOs that aren't subscribed yet,
+// or when the timeout changes. Requests that fail, or aren't confirmed, are retried in the background.
+func (s *Session) Subscribe(consumer string, subscriptions ...Subscription) error {
+	log := logrus.WithFields(logrus.Fields{
+		"module":   "comfoconnect",
+		"object":   "Session",
+		"method":   "Subscribe",
+		"consumer": consumer,
+	})
+
+	s.subscriptionLock.Lock()
+	defer s.subscriptionLock.Unlock()
+	if s.subscriptions == nil {
+		s.subscriptions = make(map[uint32]*subscription)
+	}
+
+	var failed []uint32
+	for _, request := range subscriptions {
+		timeout := request.Timeout
+		if timeout == 0 {
+			timeout = RpdoTimeoutNever
+		}
+
+		sub, ok := s.subscriptions[request.Ppid]
+		if !ok {
+			sub = &subscription{
+				ppid:      request.Ppid,
+				pdoType:   request.Type,
+				consumers: make(map[string]uint32),
+			}
+			s.subscriptions[request.Ppid] = sub
+		} else if sub.pdoType != request.Type {
+			log.Warnf("ppid %d is already subscribed with type %d, ignoring type %d", request.Ppid, sub.pdoType, request.Type)
+		}
+		sub.consumers[consumer] = timeout
+
+		if ok && sub.timeout == sub.effectiveTimeout() {
+			log.Debugf("ppid %d is already subscribed", request.Ppid)
+			continue
+		}
+		err := s.sendSubscription(sub)
+		if err != nil {
+			log.Errorf("failed to subscribe to ppid %d, will retry: %v", request.Ppid, err)
+			failed = append(failed, request.Ppid)
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.New(fmt.Sprintf("failed to send CnRpdoRequest for ppids %v, will retry", failed))
+	}
+	return nil
+}
+
+// Unsubscribe drops the interest of `consumer` in the PDOs.
+// When no other consumer is subscribed to a PDO, the gateway is asked to stop sending updates for it.
+func (s *Session) Unsubscribe(consumer string, ppids ...uint32) error {
+	log := logrus.WithFields(logrus.Fields{
+		"module":   "comfoconnect",
+		"object":   "Session",
+		"method":   "Unsubscribe",
+		"consumer": consumer,
+	})
+
+	s.subscriptionLock.Lock()
+	defer s.subscriptionLock.Unlock()
+
+	var failed []uint32
+	for _, ppid := range ppids {
+		sub, ok := s.subscriptions[ppid]
+		if !ok {
+			continue
+		}
+		if _, ok := sub.consumers[consumer]; !ok {
+			continue
+		}
+		delete(sub.consumers, consumer)
+
+		if len(sub.consumers) > 0 {
+			if sub.timeout == sub.effectiveTimeout() {
+				continue
+			}
+			// the consumer that left had the longest timeout
+			err := s.sendSubscription(sub)
+			if err != nil {
+				log.Errorf("failed to update subscription to ppid %d, will retry: %v", ppid, err)
+				failed = append(failed, ppid)
+			}
+			continue
+		}
+
+		delete(s.subscriptions, ppid)
+		_, err := s.sendRpdoRequest(ppid, sub.pdoType, 0)
+		if err != nil {
+			log.Errorf("failed to unsubscribe from ppid %d: %v", ppid, err)
+			failed = append(failed, ppid)
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.New(fmt.Sprintf("failed to send CnRpdoRequest for ppids %v", failed))
+	}
+	return nil
+}
+
+// UnsubscribeAll drops all subscriptions of `consumer`
+func (s *Session) UnsubscribeAll(consumer string) error {
+	var ppids []uint32
+	s.subscriptionLock.Lock()
+	for ppid, sub := range s.subscriptions {
+		if _, ok := sub.consumers[consumer]; ok {
+			ppids = append(ppids, ppid)
+		}
+	}
+	s.subscriptionLock.Unlock()
+
+	if len(ppids) == 0 {
+		return nil
+	}
+	return s.Unsubscribe(consumer, ppids...)
+}
+
+// Subscribed returns true when `consumer` is subscribed to `ppid`
+func (s *Session) Subscribed(consumer string, ppid uint32) bool {
+	s.subscriptionLock.Lock()
+	defer s.subscriptionLock.Unlock()
+
+	sub, ok := s.subscriptions[ppid]
+	if !ok {
+		return false
+	}
+	_, ok = sub.consumers[consumer]
+	return ok
+}
+
+// Resubscribe takes over the subscriptions of a previous session, like one that was lost, and sends them to the gateway
+func (s *Session) Resubscribe(previous *Session) error {
+	previous.subscriptionLock.Lock()
+	var subscriptions []*subscription
+	for _, sub := range previous.subscriptions {
+		consumers := make(map[string]uint32, len(sub.consumers))
+		for consumer, timeout := range sub.consumers {
+			consumers[consumer] = timeout
+		}
+		subscriptions = append(subscriptions, &subscription{
+			ppid:      sub.ppid,
+			pdoType:   sub.pdoType,
+			consumers: consumers,
+		})
+	}
+	previous.subscriptionLock.Unlock()
+
+	s.subscriptionLock.Lock()
+	defer s.subscriptionLock.Unlock()
+	if s.subscriptions == nil {
+		s.subscriptions = make(map[uint32]*subscription)
+	}
+
+	var failed []uint32
+	for _, sub := range subscriptions {
+		if existing, ok := s.subscriptions[sub.ppid]; ok {
+			for consumer, timeout := range sub.consumers {
+				existing.consumers[consumer] = timeout
+			}
+			sub = existing
+		}
+		s.subscriptions[sub.ppid] = sub
+		err := s.sendSubscription(sub)
+		if err != nil {
+			failed = append(failed, sub.ppid)
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.New(fmt.Sprintf("failed to send CnRpdoRequest for ppids %v, will retry", failed))
+	}
+	return nil
+}
+
+// Subscriptions returns the state of all subscriptions, sorted by ppid
+func (s *Session) Subscriptions() []SubscriptionStatus {
+	s.subscriptionLock.Lock()
+	defer s.subscriptionLock.Unlock()
+
+	result := make([]SubscriptionStatus, 0, len(s.subscriptions))
+	for _, sub := range s.subscriptions {
+		result = append(result, sub.status())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Ppid < result[j].Ppid
+	})
+	return result
+}
+
+// retrySubscriptions sends the requests again for subscriptions that weren't confirmed in time.
+// Must be called regularly.
+func (s *Session) retrySubscriptions() {
+	log := logrus.WithFields(logrus.Fields{
+		"module": "comfoconnect",
+		"object": "Session",
+		"method": "retrySubscriptions",
+	})
+
+	s.subscriptionLock.Lock()
+	defer s.subscriptionLock.Unlock()
+
+	for _, sub := range s.subscriptions {
+		if sub.confirmed || time.Since(sub.sentAt) < subscriptionRetryInterval {
+			continue
+		}
+		log.Warnf("no confirm for ppid %d after %d attempts, retrying", sub.ppid, sub.attempts)
+		err := s.sendSubscription(sub)
+		if err != nil {
+			log.Errorf("failed to subscribe to ppid %d: %v", sub.ppid, err)
+		}
+	}
+}
+
+// trackSubscription marks the subscription that `m` confirms
+func (s *Session) trackSubscription(m Message) {
+	if m.Operation.Type == nil || m.Operation.Type.String() != "CnRpdoConfirmType" {
+		return
+	}
+
+	s.subscriptionLock.Lock()
+	defer s.subscriptionLock.Unlock()
+
+	for _, sub := range s.subscriptions {
+		if sub.reference == 0 || sub.reference != m.Operation.GetReference() {
+			continue
+		}
+		if m.Operation.Result != nil && m.Operation.GetResult() != proto.GatewayOperation_OK {
+			logrus.WithFields(logrus.Fields{
+				"module": "comfoconnect",
+				"object": "Session",
+				"method": "trackSubscription",
+				"ppid":   sub.ppid,
+			}).Warnf("gateway returned %s, will retry", m.Operation.GetResult().String())
+			return
+		}
+		sub.confirmed = true
+		sub.reference = 0
+		return
+	}
+}
+
+// sends the CnRpdoRequest for `sub`, must be called with the subscriptionLock held
+func (s *Session) sendSubscription(sub *subscription) error {
+	sub.timeout = sub.effectiveTimeout()
+	sub.confirmed = false
+	sub.sentAt = time.Now()
+	sub.attempts++
+
+	reference, err := s.sendRpdoRequest(sub.ppid, sub.pdoType, sub.timeout)
+	sub.reference = reference
+	return err
+}
+
+func (s *Session) sendRpdoRequest(ppid uint32, pdoType PdoType, timeout uint32) (uint32, error) {
+	reference := s.nextReference()
+	operationType := proto.GatewayOperation_CnRpdoRequestType
+	zone := uint32(1)
+	pType := uint32(pdoType)
+	err := s.Send(Message{
+		Src: s.Src,
+		Dst: s.Dst,
+		Operation: proto.GatewayOperation{
+			Type:      &operationType,
+			Reference: &reference,
+		},
+		OperationType: &proto.CnRpdoRequest{
+			Pdid:    &ppid,
+			Zone:    &zone,
+			Type:    &pType,
+			Timeout: &timeout,
+		},
+		Span: opentracing.StartSpan("comfoconnect.Session.sendRpdoRequest"),
+	})
+	if err != nil {
+		return reference, errors.Wrap(err, fmt.Sprintf("sending CnRpdoRequest for ppid %d", ppid))
+	}
+	return reference, nil
+}
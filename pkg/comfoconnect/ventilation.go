@@ -0,0 +1,174 @@
+package comfoconnect
+
+import (
+	"time"
+)
+
+// DefaultStaleAfter is how long a value is considered fresh after it was received
+const DefaultStaleAfter = 5 * time.Minute
+
+// the PDOs that make up the VentilationUnit
+const (
+	ppidOperatingMode      = 56
+	ppidFanSpeedSetting    = 65
+	ppidExhaustFanDuty     = 117
+	ppidSupplyFanDuty      = 118
+	ppidExhaustFanFlow     = 119
+	ppidSupplyFanFlow      = 120
+	ppidExhaustFanSpeed    = 121
+	ppidSupplyFanSpeed     = 122
+	ppidVentilationPower   = 128
+	ppidPreheaterPower     = 146
+	ppidFilterDaysLeft     = 192
+	ppidOutdoorTemperature = 220
+	ppidSupplyTemperature  = 221
+	ppidBypass             = 227
+	ppidExtractTemperature = 274
+	ppidExhaustTemperature = 275
+	ppidExtractHumidity    = 290
+	ppidExhaustHumidity    = 291
+	ppidOutdoorHumidity    = 292
+	ppidSupplyHumidity     = 294
+)
+
+// Reading is a single value of the ventilation unit.
+// A reading that was never received has a zero Updated and is not Fresh.
+type Reading struct {
+	Value   float64   `json:"value"`
+	State   string    `json:"state,omitempty"` // the symbolic value, for PDOs that have one
+	Unit    string    `json:"unit,omitempty"`
+	Updated time.Time `json:"updated"`
+	Fresh   bool      `json:"fresh"`
+}
+
+type Temperatures struct {
+	Outdoor Reading `json:"outdoor"`
+	Supply  Reading `json:"supply"`
+	Extract Reading `json:"extract"`
+	Exhaust Reading `json:"exhaust"`
+}
+
+type Humidity struct {
+	Outdoor Reading `json:"outdoor"`
+	Supply  Reading `json:"supply"`
+	Extract Reading `json:"extract"`
+	Exhaust Reading `json:"exhaust"`
+}
+
+type Fan struct {
+	Duty  Reading `json:"duty"`
+	Flow  Reading `json:"flow"`
+	Speed Reading `json:"speed"`
+}
+
+type Fans struct {
+	Setting Reading `json:"setting"`
+	Supply  Fan     `json:"supply"`
+	Exhaust Fan     `json:"exhaust"`
+}
+
+type Power struct {
+	Ventilation Reading `json:"ventilation"`
+	Preheater   Reading `json:"preheater"`
+}
+
+type Filter struct {
+	DaysLeft Reading `json:"days_left"`
+}
+
+// VentilationUnit is a snapshot of the state of the ventilation unit, built from the PDOs that were received
+type VentilationUnit struct {
+	TakenAt       time.Time    `json:"taken_at"`
+	Temperatures  Temperatures `json:"temperatures"`
+	Humidity      Humidity     `json:"humidity"`
+	Fans          Fans         `json:"fans"`
+	Power         Power        `json:"power"`
+	Bypass        Reading      `json:"bypass"`
+	Filter        Filter       `json:"filter"`
+	OperatingMode Reading      `json:"operating_mode"`
+	Alarms        []Alarm      `json:"alarms"`
+	Derived       Derived      `json:"derived"`
+}
+
+// VentilationUnit builds a snapshot from the store. Values older than `staleAfter` are marked as not fresh,
+// 0 means DefaultStaleAfter.
+func (s *StateStore) VentilationUnit(staleAfter time.Duration) VentilationUnit {
+	if staleAfter == 0 {
+		staleAfter = DefaultStaleAfter
+	}
+	now := time.Now()
+
+	reading := func(ppid uint32) Reading {
+		r := Reading{}
+		if definition, ok := GetCatalog().Get(ppid); ok {
+			r.Unit = definition.Unit
+		}
+		state, ok := s.Get(ppid)
+		if !ok {
+			return r
+		}
+		r.Value = state.Value.Tofloat64()
+		r.State, _ = state.Value.GetState()
+		r.Updated = state.Received
+		r.Fresh = now.Sub(state.Received) <= staleAfter
+		return r
+	}
+
+	unit := VentilationUnit{
+		TakenAt: now,
+		Temperatures: Temperatures{
+			Outdoor: reading(ppidOutdoorTemperature),
+			Supply:  reading(ppidSupplyTemperature),
+			Extract: reading(ppidExtractTemperature),
+			Exhaust: reading(ppidExhaustTemperature),
+		},
+		Humidity: Humidity{
+			Outdoor: reading(ppidOutdoorHumidity),
+			Supply:  reading(ppidSupplyHumidity),
+			Extract: reading(ppidExtractHumidity),
+			Exhaust: reading(ppidExhaustHumidity),
+		},
+		Fans: Fans{
+			Setting: reading(ppidFanSpeedSetting),
+			Supply: Fan{
+				Duty:  reading(ppidSupplyFanDuty),
+				Flow:  reading(ppidSupplyFanFlow),
+				Speed: reading(ppidSupplyFanSpeed),
+			},
+			Exhaust: Fan{
+				Duty:  reading(ppidExhaustFanDuty),
+				Flow:  reading(ppidExhaustFanFlow),
+				Speed: reading(ppidExhaustFanSpeed),
+			},
+		},
+		Power: Power{
+			Ventilation: reading(ppidVentilationPower),
+			Preheater:   reading(ppidPreheaterPower),
+		},
+		Bypass:        reading(ppidBypass),
+		Filter:        Filter{DaysLeft: reading(ppidFilterDaysLeft)},
+		OperatingMode: reading(ppidOperatingMode),
+		Alarms:        s.Alarms(),
+	}
+	unit.Derived = Derive(unit)
+	return unit
+}
+
+// VentilationUnitPpids returns the PDOs that are needed for a complete VentilationUnit, to subscribe to
+func VentilationUnitPpids() []uint32 {
+	return []uint32{
+		ppidOperatingMode, ppidFanSpeedSetting,
+		ppidExhaustFanDuty, ppidSupplyFanDuty, ppidExhaustFanFlow, ppidSupplyFanFlow, ppidExhaustFanSpeed, ppidSupplyFanSpeed,
+		ppidVentilationPower, ppidPreheaterPower, ppidFilterDaysLeft, ppidBypass,
+		ppidOutdoorTemperature, ppidSupplyTemperature, ppidExtractTemperature, ppidExhaustTemperature,
+		ppidOutdoorHumidity, ppidSupplyHumidity, ppidExtractHumidity, ppidExhaustHumidity,
+	}
+}
+
+// GetState returns a snapshot of the ventilation unit, from the values received through this session
+func (s *Session) GetState() VentilationUnit {
+	if s.State == nil {
+		return VentilationUnit{TakenAt: time.Now(), Alarms: []Alarm{}}
+	}
+	return s.State.VentilationUnit(DefaultStaleAfter)
+}
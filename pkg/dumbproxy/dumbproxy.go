@@ -11,25 +11,19 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 
 	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
+	"github.com/hsmade/comfoconnectbridge/pkg/instrumentation"
 	"github.com/hsmade/comfoconnectbridge/proto"
 )
 
-var (
-	metricsGauge = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "comfoconnect_pdo_value",
-			Help: "Value for the different PDOs, as they're seen by the proxy",
-		},
-		[]string{"ID", "description"},
-	)
-)
-
 type DumbProxy struct {
 	GatewayIP string
+
+	// State holds the latest values that passed through the proxy, export it with instrumentation.NewPdoCollector.
+	// Created by Run when nil.
+	State *comfoconnect.StateStore
 }
 
 func (d DumbProxy) Run(ctx context.Context, wg *sync.WaitGroup) {
@@ -38,7 +32,9 @@ func (d DumbProxy) Run(ctx context.Context, wg *sync.WaitGroup) {
 		"object": "DumbProxy",
 		"method": "Run",
 	})
-	prometheus.MustRegister(metricsGauge)
+	if d.State == nil {
+		d.State = comfoconnect.NewStateStore()
+	}
 
 	log.Info("starting proxy")
 
@@ -108,8 +104,8 @@ func (d DumbProxy) proxyReceiveMessage(conn net.Conn, channel chan []byte) {
 		if err == nil {
 			log.Infof("received %v from %s", message, conn.RemoteAddr().String())
 			if message.Operation.Type != nil {
-				generateMetrics(message)
-				channel <- message.Encode()
+				d.generateMetrics(message)
+				channel <- message.Forward()
 			}
 		} else {
 			if errors.Cause(err) == io.EOF {
@@ -138,21 +134,26 @@ func (d DumbProxy) proxySend(conn net.Conn, channel chan []byte) {
 	}
 }
 
-func generateMetrics(message comfoconnect.Message) {
-
+func (d DumbProxy) generateMetrics(message comfoconnect.Message) {
 	log := logrus.WithFields(logrus.Fields{
 		"module": "proxy",
 		"method": "generateMetrics",
 	})
 
+	d.State.Update(message)
+
 	switch message.Operation.Type.String() {
 	case "CnRpdoRequestType":
 		b := message.OperationType.(*proto.CnRpdoRequest)
 		log.Infof("CnRpdoRequestType: ppid:%d type:%d zone:%d", *b.Pdid, *b.Type, *b.Zone)
 	case "CnRpdoNotificationType":
 		conv := message.DecodePDO()
+		if err := conv.Validate(); err != nil {
+			log.Warnf("ignoring invalid RPDO: %v", err)
+			break
+		}
 		log.Infof("Got RPDO: %s %v with value %f", reflect.TypeOf(conv), conv, conv.Tofloat64())
-		metricsGauge.WithLabelValues(conv.GetID(), conv.GetDescription()).Set(conv.Tofloat64())
+		instrumentation.UpdateEnergyMetrics(message.OperationType.(*proto.CnRpdoNotification).GetPdid(), conv)
 	case "CnAlarmNotificationType":
 		log.Warnf("Got alarm notification: %v", message)
 	}
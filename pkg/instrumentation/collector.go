@@ -0,0 +1,141 @@
+package instrumentation
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
+)
+
+var invalidMetricCharacters = regexp.MustCompile("[^a-zA-Z0-9_]+")
+
+var (
+	pdoInfoDesc = prometheus.NewDesc(
+		"comfoconnect_pdo_info",
+		"Description of the PDOs, to join on the ID label",
+		[]string{"ID", "description", "category", "unit"}, nil,
+	)
+	pdoLastUpdateDesc = prometheus.NewDesc(
+		"comfoconnect_pdo_last_update_timestamp_seconds",
+		"When the PDO was last received from the gateway",
+		[]string{"ID"}, nil,
+	)
+	pdoStateDesc = prometheus.NewDesc(
+		"comfoconnect_pdo_state",
+		"State of the PDOs with symbolic values, 1 for the current state and 0 for the others",
+		[]string{"ID", "description", "state"}, nil,
+	)
+	// kept for existing dashboards, use the per category metrics instead
+	pdoValueDesc = prometheus.NewDesc(
+		"comfoconnect_pdo_value",
+		"Value for the different PDOs, as they're seen by the proxy",
+		[]string{"ID", "description"}, nil,
+	)
+)
+
+// PdoCollector exports the PDOs in a state store as metrics named after their category and unit,
+// like comfoconnect_temperature_celsius. PDOs that weren't received within the staleness window are left out,
+// so no values are exported while the gateway is unreachable.
+type PdoCollector struct {
+	store      *comfoconnect.StateStore
+	staleAfter time.Duration
+}
+
+// NewPdoCollector creates the collector for `store`, 0 for `staleAfter` means comfoconnect.DefaultStaleAfter
+func NewPdoCollector(store *comfoconnect.StateStore, staleAfter time.Duration) *PdoCollector {
+	if staleAfter == 0 {
+		staleAfter = comfoconnect.DefaultStaleAfter
+	}
+	return &PdoCollector{
+		store:      store,
+		staleAfter: staleAfter,
+	}
+}
+
+// Describe sends nothing, which makes this an unchecked collector, as the metric names depend on the catalog
+func (c *PdoCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (c *PdoCollector) Collect(ch chan<- prometheus.Metric) {
+	catalog := comfoconnect.GetCatalog()
+	descs := make(map[string]*prometheus.Desc)
+
+	for _, state := range c.store.All() {
+		if time.Since(state.Received) > c.staleAfter {
+			continue
+		}
+		conv := state.Value
+		definition, ok := catalog.Get(state.Ppid)
+		if !ok {
+			definition = comfoconnect.PdoDefinition{ID: state.Ppid, Name: conv.GetDescription(), Category: "unknown"}
+		}
+		id := conv.GetID()
+		value := conv.Tofloat64()
+
+		name := metricName(definition)
+		desc, ok := descs[name]
+		if !ok {
+			desc = prometheus.NewDesc(name, "Value of the PDOs in category "+definition.Category+", see comfoconnect_pdo_info for what they are", []string{"ID"}, nil)
+			descs[name] = desc
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, id)
+		ch <- prometheus.MustNewConstMetric(pdoInfoDesc, prometheus.GaugeValue, 1, id, definition.Name, definition.Category, definition.Unit)
+		ch <- prometheus.MustNewConstMetric(pdoLastUpdateDesc, prometheus.GaugeValue, float64(state.Received.UnixNano())/1e9, id)
+		ch <- prometheus.MustNewConstMetric(pdoValueDesc, prometheus.GaugeValue, value, id, conv.GetDescription())
+
+		current, _ := conv.GetState()
+		for _, s := range conv.GetStates() {
+			v := 0.0
+			if s.Name == current {
+				v = 1
+			}
+			ch <- prometheus.MustNewConstMetric(pdoStateDesc, prometheus.GaugeValue, v, id, conv.GetDescription(), s.Name)
+		}
+	}
+
+	// derived values are left out as soon as one of their inputs is stale
+	for _, reading := range c.store.VentilationUnit(c.staleAfter).Derived.Readings() {
+		if reading.Updated.IsZero() || !reading.Fresh {
+			continue
+		}
+		name := "comfoconnect_derived_" + reading.Name + "_" + reading.Unit
+		desc, ok := descs[name]
+		if !ok {
+			if reading.Air == "" {
+				desc = prometheus.NewDesc(name, "Value calculated from the PDOs", nil, nil)
+			} else {
+				desc = prometheus.NewDesc(name, "Value calculated from the temperature and humidity of an air stream", []string{"air"}, nil)
+			}
+			descs[name] = desc
+		}
+		if reading.Air == "" {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, reading.Value)
+		} else {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, reading.Value, reading.Air)
+		}
+	}
+}
+
+// returns comfoconnect_<category>_<unit>, or comfoconnect_<category>_value when there is no unit
+func metricName(definition comfoconnect.PdoDefinition) string {
+	category := definition.Category
+	if category == "" {
+		category = "unknown"
+	}
+	unit := definition.Unit
+	if unit == "" {
+		unit = "value"
+	}
+	// don't repeat the unit when the category already ends with it
+	if strings.HasSuffix(category, "_"+unit) {
+		unit = ""
+	}
+	name := "comfoconnect_" + category
+	if unit != "" {
+		name += "_" + unit
+	}
+	return strings.ToLower(invalidMetricCharacters.ReplaceAllString(name, "_"))
+}
@@ -0,0 +1,51 @@
+package instrumentation
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
+)
+
+var (
+	metricsEnergyCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "comfoconnect_energy_joules_total",
+			Help: "Energy from the cumulative PDOs, resets of the totals on the device are counted separately",
+		},
+		[]string{"ID", "description"},
+	)
+	metricsEnergyResets = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "comfoconnect_energy_resets_total",
+			Help: "Number of times a cumulative PDO went down, because of a yearly rollover or a reset of the device",
+		},
+		[]string{"ID", "description", "reason"},
+	)
+	energyCounters = comfoconnect.NewEnergyCounters()
+	energyRegister sync.Once
+)
+
+// UpdateEnergyMetrics adds the increment of cumulative PDOs to the energy counters.
+// The counters are registered with prometheus on the first call.
+func UpdateEnergyMetrics(ppid uint32, conv comfoconnect.RpdoTypeConverter) {
+	energyRegister.Do(func() {
+		prometheus.MustRegister(metricsEnergyCounter)
+		prometheus.MustRegister(metricsEnergyResets)
+	})
+
+	increment, ok := energyCounters.Observe(ppid, conv)
+	if !ok {
+		return
+	}
+	if increment.Reset {
+		logrus.WithFields(logrus.Fields{
+			"module": "instrumentation",
+			"method": "UpdateEnergyMetrics",
+		}).Warnf("%s went down (%s), counting from 0 again", conv.GetDescription(), increment.Reason)
+		metricsEnergyResets.WithLabelValues(conv.GetID(), conv.GetDescription(), increment.Reason).Inc()
+	}
+	metricsEnergyCounter.WithLabelValues(conv.GetID(), conv.GetDescription()).Add(increment.Joules)
+}
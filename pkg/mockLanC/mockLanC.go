@@ -1,6 +1,7 @@
 package mockLanC
 
 import (
+	"bytes"
 	"io"
 	"net"
 	"sync"
@@ -15,12 +16,39 @@ import (
 	"github.com/hsmade/comfoconnectbridge/proto"
 )
 
+// the largest chunk the mock accepts in a CnFupProgramRequest
+const maxChunkSize = 256
+
 type MockLanC struct {
 	myIP           string // IP to bind to and return with on broadcast requests
 	comfoconnectIP string
 	listener       *net.TCPListener
 	quit           chan bool
 	exited         chan bool
+
+	lock        sync.Mutex
+	nodes       []*proto.CnNodeNotification
+	programming []uint32 // nodes that are currently being programmed
+	image       []byte   // the image received while programming
+
+	ResetKey       []byte // the key a FactoryReset has to carry
+	serialNumber   string
+	macAddress     []byte
+	address        []byte // the uuid of the gateway, as set by SetAddressRequest
+	remoteAccessID []byte
+	supportID      []byte
+	webID          []byte
+	apps           []*proto.ListRegisteredAppsConfirm_App
+}
+
+func newNode(nodeID, productID, zoneID uint32) *proto.CnNodeNotification {
+	mode := proto.CnNodeNotification_NODE_NORMAL
+	return &proto.CnNodeNotification{
+		NodeId:    &nodeID,
+		ProductId: &productID,
+		ZoneId:    &zoneID,
+		Mode:      &mode,
+	}
 }
 
 func NewMockLanC(myIP, comfoconnectIP string) *MockLanC {
@@ -40,6 +68,14 @@ func NewMockLanC(myIP, comfoconnectIP string) *MockLanC {
 		listener:       listener,
 		quit:           make(chan bool),
 		exited:         make(chan bool),
+		nodes: []*proto.CnNodeNotification{
+			newNode(1, 1, 1),
+			newNode(48, 5, 255),
+		},
+		ResetKey:       []byte{0x5a, 0xc3, 0x0f, 0x81},
+		serialNumber:   "DEM0116371204",
+		macAddress:     []byte{0xe2, 0x03, 0x56, 0x7c, 0x4d, 0x2c},
+		remoteAccessID: []byte("7m\351\332}\322C\346\270\336^G\307\223Y\\"),
 	}
 
 	return &b
@@ -112,38 +148,220 @@ func (m *MockLanC) handleClient(conn net.Conn) error {
 		logrus.Infof("got a message from: %s: %v", conn.RemoteAddr(), message)
 
 		switch message.Operation.Type.String() {
-		//case "StartSessionRequestType":
-		//	m.respond(conn, message.CreateResponse(proto.GatewayOperation_OK))
 		case "StartSessionRequestType":
 			m.respond(conn, message.CreateResponse(nil, proto.GatewayOperation_OK))
-
-			i := uint32(1)
-			mode := proto.CnNodeNotification_NODE_NORMAL
-			a := proto.CnNodeNotification{
-				NodeId:    &i,
-				ProductId: &i,
-				ZoneId:    &i,
-				Mode:      &mode,
+			m.notifyNodes(conn, message)
+		case "CnNodeRequestType":
+			m.notifyNodes(conn, message)
+		case "CnFupProgramBeginRequestType":
+			request := message.OperationType.(*proto.CnFupProgramBeginRequest)
+			m.respond(conn, message.CreateResponse(nil, m.programBegin(request.GetNode())))
+			m.notifyNodes(conn, message)
+		case "CnFupProgramRequestType":
+			request := message.OperationType.(*proto.CnFupProgramRequest)
+			m.respond(conn, message.CreateResponse(nil, m.program(request.GetChunk())))
+		case "CnFupProgramEndRequestType":
+			m.respond(conn, message.CreateResponse(nil, m.programEnd()))
+		case "CnFupResetRequestType":
+			request := message.OperationType.(*proto.CnFupResetRequest)
+			m.respond(conn, message.CreateResponse(nil, m.reset(request.GetNode())))
+			m.notifyNodes(conn, message)
+		case "RegisterAppRequestType":
+			request := message.OperationType.(*proto.RegisterAppRequest)
+			m.registerApp(request.GetUuid(), request.GetDevicename())
+			m.respond(conn, message.CreateResponse(nil, proto.GatewayOperation_OK))
+		case "ListRegisteredAppsRequestType":
+			m.respond(conn, message.CreateCustomResponse(nil, proto.GatewayOperation_ListRegisteredAppsConfirmType, m.listRegisteredApps()))
+		case "VersionRequestType":
+			m.respond(conn, message.CreateCustomResponse(nil, proto.GatewayOperation_VersionConfirmType, m.version()))
+		case "GetRemoteAccessIdRequestType":
+			m.lock.Lock()
+			confirm := proto.GetRemoteAccessIdConfirm{Uuid: m.remoteAccessID}
+			m.lock.Unlock()
+			m.respond(conn, message.CreateCustomResponse(nil, proto.GatewayOperation_GetRemoteAccessIdConfirmType, &confirm))
+		case "GetSupportIdRequestType":
+			m.lock.Lock()
+			confirm := proto.GetSupportIdConfirm{Uuid: m.supportID}
+			m.lock.Unlock()
+			m.respond(conn, message.CreateCustomResponse(nil, proto.GatewayOperation_GetSupportIdConfirmType, &confirm))
+		case "GetWebIdRequestType":
+			m.lock.Lock()
+			confirm := proto.GetWebIdConfirm{Uuid: m.webID}
+			m.lock.Unlock()
+			m.respond(conn, message.CreateCustomResponse(nil, proto.GatewayOperation_GetWebIdConfirmType, &confirm))
+		case "SetDeviceSettingsRequestType":
+			request := message.OperationType.(*proto.SetDeviceSettingsRequest)
+			m.lock.Lock()
+			m.macAddress = request.GetMacAddress()
+			m.serialNumber = request.GetSerialNumber()
+			m.lock.Unlock()
+			logrus.Infof("device settings changed to mac=%x serial=%s", request.GetMacAddress(), request.GetSerialNumber())
+			m.respond(conn, message.CreateResponse(nil, proto.GatewayOperation_OK))
+		case "SetAddressRequestType":
+			request := message.OperationType.(*proto.SetAddressRequest)
+			m.lock.Lock()
+			m.address = request.GetUuid()
+			m.lock.Unlock()
+			logrus.Infof("address changed to %x", request.GetUuid())
+			m.respond(conn, message.CreateResponse(nil, proto.GatewayOperation_OK))
+		case "FactoryResetType":
+			request := message.OperationType.(*proto.FactoryReset)
+			if !bytes.Equal(request.GetResetKey(), m.ResetKey) {
+				// there is no confirm for a factory reset, so the wrong key is just ignored
+				logrus.Warnf("ignoring factory reset with the wrong key: %x", request.GetResetKey())
+				continue
 			}
-
-			m.respond(conn, message.CreateCustomResponse(nil, proto.GatewayOperation_CnNodeNotificationType, &a))
-			i48 := uint32(48)
-			i5 := uint32(5)
-			i255 := uint32(255)
-			mode = proto.CnNodeNotification_NODE_NORMAL
-			a = proto.CnNodeNotification{
-				NodeId:    &i48,
-				ProductId: &i5,
-				ZoneId:    &i255,
-				Mode:      &mode,
+			m.factoryReset()
+			return errors.New("factory reset, closing connection")
+		case "CnRpdoRequestType":
+			request := message.OperationType.(*proto.CnRpdoRequest)
+			if request.GetTimeout() == 0 {
+				logrus.Infof("unsubscribed from ppid %d", request.GetPdid())
+			} else {
+				logrus.Infof("subscribed to ppid %d with timeout %d", request.GetPdid(), request.GetTimeout())
 			}
-			m.respond(conn, message.CreateCustomResponse(nil, proto.GatewayOperation_CnNodeNotificationType, &a))
+			m.respond(conn, message.CreateResponse(nil, proto.GatewayOperation_OK))
+		case "DebugRequestType":
+			request := message.OperationType.(*proto.DebugRequest)
+			result := request.GetArgument() // echo the argument back
+			m.respond(conn, message.CreateCustomResponse(nil, proto.GatewayOperation_DebugConfirmType, &proto.DebugConfirm{Result: &result}))
 		default:
 			m.respond(conn, message.CreateResponse(nil, -1))
 		}
 	}
 }
 
+func (m *MockLanC) registerApp(uuid []byte, deviceName string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, app := range m.apps {
+		if bytes.Equal(app.GetUuid(), uuid) {
+			app.Devicename = &deviceName
+			return
+		}
+	}
+	m.apps = append(m.apps, &proto.ListRegisteredAppsConfirm_App{
+		Uuid:       uuid,
+		Devicename: &deviceName,
+	})
+}
+
+func (m *MockLanC) listRegisteredApps() *proto.ListRegisteredAppsConfirm {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	apps := make([]*proto.ListRegisteredAppsConfirm_App, len(m.apps))
+	copy(apps, m.apps)
+	return &proto.ListRegisteredAppsConfirm{Apps: apps}
+}
+
+func (m *MockLanC) version() *proto.VersionConfirm {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	gw := uint32(1049610)
+	cn := uint32(1073750016)
+	serial := m.serialNumber
+	return &proto.VersionConfirm{
+		GatewayVersion:  &gw,
+		SerialNumber:    &serial,
+		ComfoNetVersion: &cn,
+	}
+}
+
+// forget about all registered apps and IDs
+func (m *MockLanC) factoryReset() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	logrus.Warn("factory reset")
+	m.apps = nil
+	m.remoteAccessID = nil
+	m.supportID = nil
+	m.webID = nil
+}
+
+// send a CnNodeNotification for each of the nodes
+func (m *MockLanC) notifyNodes(conn net.Conn, message comfoconnect.Message) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, node := range m.nodes {
+		m.respond(conn, message.CreateCustomResponse(nil, proto.GatewayOperation_CnNodeNotificationType, node))
+	}
+}
+
+func (m *MockLanC) findNode(nodeID uint32) *proto.CnNodeNotification {
+	for _, node := range m.nodes {
+		if node.GetNodeId() == nodeID {
+			return node
+		}
+	}
+	return nil
+}
+
+// puts the nodes into update mode
+func (m *MockLanC) programBegin(nodeIDs []uint32) proto.GatewayOperation_GatewayResult {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(m.programming) > 0 || len(nodeIDs) == 0 {
+		return proto.GatewayOperation_BAD_REQUEST
+	}
+	for _, nodeID := range nodeIDs {
+		if m.findNode(nodeID) == nil {
+			return proto.GatewayOperation_NOT_EXIST
+		}
+	}
+	for _, nodeID := range nodeIDs {
+		mode := proto.CnNodeNotification_NODE_UPDATE
+		m.findNode(nodeID).Mode = &mode
+	}
+	m.programming = nodeIDs
+	m.image = nil
+	logrus.Infof("started programming nodes: %v", nodeIDs)
+	return proto.GatewayOperation_OK
+}
+
+func (m *MockLanC) program(chunk []byte) proto.GatewayOperation_GatewayResult {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(m.programming) == 0 || len(chunk) > maxChunkSize {
+		return proto.GatewayOperation_BAD_REQUEST
+	}
+	m.image = append(m.image, chunk...)
+	return proto.GatewayOperation_OK
+}
+
+func (m *MockLanC) programEnd() proto.GatewayOperation_GatewayResult {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(m.programming) == 0 {
+		return proto.GatewayOperation_BAD_REQUEST
+	}
+	logrus.Infof("received image of %d bytes for nodes: %v", len(m.image), m.programming)
+	m.programming = nil
+	return proto.GatewayOperation_OK
+}
+
+// takes the node out of update mode, aborting the programming when it didn't end
+func (m *MockLanC) reset(nodeID uint32) proto.GatewayOperation_GatewayResult {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	node := m.findNode(nodeID)
+	if node == nil {
+		return proto.GatewayOperation_NOT_EXIST
+	}
+	if len(m.programming) > 0 {
+		logrus.Warnf("aborted programming of %d bytes for nodes: %v", len(m.image), m.programming)
+		m.programming = nil
+		m.image = nil
+	}
+	mode := proto.CnNodeNotification_NODE_NORMAL
+	node.Mode = &mode
+	logrus.Infof("reset node: %d", nodeID)
+	return proto.GatewayOperation_OK
+}
+
 func (m *MockLanC) Stop() {
 	logrus.Info("Stopping tcp server")
 	close(m.quit)
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// AppState is where a connected app is in its lifecycle
+type AppState string
+
+const (
+	AppConnected  AppState = "connected"  // connected, but not registered
+	AppRegistered AppState = "registered" // registered with the right PIN, or closed its session
+	AppSession    AppState = "session"    // started a session
+	AppClosed     AppState = "closed"     // disconnected, or kicked
+)
+
+var (
+	appInfoDesc = prometheus.NewDesc(
+		"comfoconnect_proxy_app_info",
+		"The connected apps, to join on the app label, 1 for the current state",
+		[]string{"app", "device_name", "state"}, nil,
+	)
+	appConnectedSinceDesc = prometheus.NewDesc(
+		"comfoconnect_proxy_app_connected_since_timestamp_seconds",
+		"When the app connected",
+		[]string{"app"}, nil,
+	)
+	appMessagesReceivedDesc = prometheus.NewDesc(
+		"comfoconnect_proxy_app_messages_received_total",
+		"Number of messages received from the app",
+		[]string{"app"}, nil,
+	)
+	appMessagesSentDesc = prometheus.NewDesc(
+		"comfoconnect_proxy_app_messages_sent_total",
+		"Number of messages written to the app",
+		[]string{"app"}, nil,
+	)
+)
+
+// AppInfo describes a connected app. It has no UUID, that is what the app authenticates with.
+type AppInfo struct {
+	ID               string    `json:"id"`
+	DeviceName       string    `json:"device_name"`
+	RemoteAddr       string    `json:"remote_addr"`
+	State            AppState  `json:"state"`
+	ConnectedSince   time.Time `json:"connected_since"`
+	MessagesReceived uint64    `json:"messages_received"`
+	MessagesSent     uint64    `json:"messages_sent"`
+	MessagesDropped  uint64    `json:"messages_dropped"`
+	QueueLength      int       `json:"queue_length"`
+}
+
+// AppRegistry keeps the apps that are connected to the proxy. Apps are added when they connect, and removed when
+// their connection closes. It exports them as metrics, and serves them over HTTP.
+type AppRegistry struct {
+	lock sync.Mutex
+	apps map[string]*App
+}
+
+func newAppRegistry() *AppRegistry {
+	return &AppRegistry{apps: make(map[string]*App)}
+}
+
+func (r *AppRegistry) add(app *App) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.apps[app.ID()] = app
+}
+
+// remove returns false when the app was already removed
+func (r *AppRegistry) remove(app *App) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.apps[app.ID()] != app {
+		return false
+	}
+	delete(r.apps, app.ID())
+	return true
+}
+
+// List returns the connected apps, in the order they connected
+func (r *AppRegistry) List() []*App {
+	r.lock.Lock()
+	apps := make([]*App, 0, len(r.apps))
+	for _, app := range r.apps {
+		apps = append(apps, app)
+	}
+	r.lock.Unlock()
+
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].connected.Before(apps[j].connected)
+	})
+	return apps
+}
+
+// Get returns the app with ID `id`, see App.ID
+func (r *AppRegistry) Get(id string) (*App, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	app, ok := r.apps[id]
+	return app, ok
+}
+
+// Info describes the connected apps, in the order they connected
+func (r *AppRegistry) Info() []AppInfo {
+	apps := r.List()
+	info := make([]AppInfo, 0, len(apps))
+	for _, app := range apps {
+		info = append(info, app.Info())
+	}
+	return info
+}
+
+// Kick disconnects the app with ID `id`. It's removed when its connection handler notices.
+func (r *AppRegistry) Kick(id string) error {
+	app, ok := r.Get(id)
+	if !ok {
+		return errors.New(fmt.Sprintf("app %s isn't connected", id))
+	}
+	logrus.WithFields(logrus.Fields{
+		"module": "proxy",
+		"object": "AppRegistry",
+		"method": "Kick",
+		"app":    id,
+	}).Warnf("kicking app %s", app.DeviceName())
+	app.Close()
+	return nil
+}
+
+func (r *AppRegistry) Describe(ch chan<- *prometheus.Desc) {
+	ch <- appInfoDesc
+	ch <- appConnectedSinceDesc
+	ch <- appMessagesReceivedDesc
+	ch <- appMessagesSentDesc
+}
+
+func (r *AppRegistry) Collect(ch chan<- prometheus.Metric) {
+	for _, info := range r.Info() {
+		for _, state := range []AppState{AppConnected, AppRegistered, AppSession} {
+			v := 0.0
+			if state == info.State {
+				v = 1
+			}
+			ch <- prometheus.MustNewConstMetric(appInfoDesc, prometheus.GaugeValue, v, info.ID, info.DeviceName, string(state))
+		}
+		ch <- prometheus.MustNewConstMetric(appConnectedSinceDesc, prometheus.GaugeValue, float64(info.ConnectedSince.UnixNano())/1e9, info.ID)
+		ch <- prometheus.MustNewConstMetric(appMessagesReceivedDesc, prometheus.CounterValue, float64(info.MessagesReceived), info.ID)
+		ch <- prometheus.MustNewConstMetric(appMessagesSentDesc, prometheus.CounterValue, float64(info.MessagesSent), info.ID)
+	}
+}
+
+// ServeHTTP lists the connected apps as JSON on GET, see KickHandler to disconnect them. Serve it behind RequireToken.
+func (r *AppRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(r.Info())
+}
+
+// KickHandler kicks the app with the `id` query parameter on DELETE. Serve it behind RequireToken.
+func (r *AppRegistry) KickHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id := req.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "missing id", http.StatusBadRequest)
+			return
+		}
+		if err := r.Kick(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// Info describes the app
+func (a *App) Info() AppInfo {
+	return AppInfo{
+		ID:               a.ID(),
+		DeviceName:       a.DeviceName(),
+		RemoteAddr:       a.conn.RemoteAddr().String(),
+		State:            a.State(),
+		ConnectedSince:   a.connected,
+		MessagesReceived: atomic.LoadUint64(&a.received),
+		MessagesSent:     atomic.LoadUint64(&a.sent),
+		MessagesDropped:  atomic.LoadUint64(&a.dropped),
+		QueueLength:      a.outbox.len(),
+	}
+}
+
+// State returns where the app is in its lifecycle
+func (a *App) State() AppState {
+	state, _ := a.state.Load().(AppState)
+	if state == "" {
+		return AppConnected
+	}
+	return state
+}
+
+func (a *App) setState(state AppState) {
+	a.state.Store(state)
+}
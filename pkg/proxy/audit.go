@@ -0,0 +1,452 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
+	"github.com/hsmade/comfoconnectbridge/proto"
+)
+
+const (
+	DefaultAuditMaxSize  = 10 * 1024 * 1024
+	DefaultAuditMaxFiles = 5
+)
+
+// the operation types that change something, besides RMI requests that don't only read (see rmiReadCommands)
+var auditedOperationTypes = map[string]bool{
+	"SetAddressRequestType":        true,
+	"DeregisterAppRequestType":     true,
+	"ChangePinRequestType":         true,
+	"SetRemoteAccessIdRequestType": true,
+	"SetSupportIdRequestType":      true,
+	"SetWebIdRequestType":          true,
+	"SetPushIdRequestType":         true,
+	"DebugRequestType":             true,
+	"UpgradeRequestType":           true,
+	"SetDeviceSettingsRequestType": true,
+	"FactoryResetType":             true,
+	"CnFupProgramBeginRequestType": true,
+	"CnFupProgramRequestType":      true,
+	"CnFupProgramEndRequestType":   true,
+	"CnFupResetRequestType":        true,
+}
+
+// audited returns true for messages that change the state of the gateway or the ventilation unit
+func audited(message comfoconnect.Message) bool {
+	if auditedOperationTypes[message.Operation.Type.String()] {
+		return true
+	}
+	switch request := message.OperationType.(type) {
+	case *proto.CnRmiRequest:
+		return len(request.GetMessage()) == 0 || !rmiReadCommands[request.GetMessage()[0]]
+	case *proto.CnRmiAsyncRequest:
+		return len(request.GetMessage()) == 0 || !rmiReadCommands[request.GetMessage()[0]]
+	}
+	return false
+}
+
+// AuditRecord is a state-changing request of an app, with how it was answered
+type AuditRecord struct {
+	Time          time.Time   `json:"time"`
+	AppUUID       string      `json:"app_uuid"`
+	DeviceName    string      `json:"device_name"`
+	RemoteAddr    string      `json:"remote_addr"`
+	OperationType string      `json:"operation_type"`
+	Request       interface{} `json:"request,omitempty"`
+	Result        string      `json:"result"`                 // the result of the gateway, or NO_RESPONSE
+	RmiResult     *uint32     `json:"rmi_result,omitempty"`   // the result of the ventilation unit, for RMI requests
+	RmiResponse   string      `json:"rmi_response,omitempty"` // hex
+	AnsweredBy    string      `json:"answered_by"`            // gateway or proxy
+	LatencyMs     float64     `json:"latency_ms"`
+}
+
+// auditRmi is how RMI requests are logged, with the message in hex instead of base64
+type auditRmi struct {
+	NodeId  uint32 `json:"node_id"`
+	Message string `json:"message"`
+}
+
+// auditRequest returns what's logged of the request, without PINs and firmware
+func auditRequest(message comfoconnect.Message) interface{} {
+	switch request := message.OperationType.(type) {
+	case *proto.CnRmiRequest:
+		return auditRmi{NodeId: request.GetNodeId(), Message: hex.EncodeToString(request.GetMessage())}
+	case *proto.CnRmiAsyncRequest:
+		return auditRmi{NodeId: request.GetNodeId(), Message: hex.EncodeToString(request.GetMessage())}
+	case *proto.ChangePinRequest:
+		return nil
+	case *proto.UpgradeRequest:
+		return map[string]interface{}{"command": request.GetCommand().String(), "chunk_length": len(request.GetChunk())}
+	case *proto.CnFupProgramRequest:
+		return nil
+	}
+	return message.OperationType
+}
+
+// a request that was forwarded, waiting for the response of the gateway
+type pendingAudit struct {
+	record  AuditRecord
+	started time.Time
+}
+
+// AuditLog writes an AuditRecord for every state-changing request of an app, to a JSON-lines file that is rotated
+// when it reaches its maximum size. It is an Interceptor, that matches the responses of the gateway by reference.
+type AuditLog struct {
+	lock     sync.Mutex
+	rotation sync.Mutex // held while the files are moved, and by Query while it opens them
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	pending  map[uint32]pendingAudit
+}
+
+// NewAuditLog appends to the file at `path`. When it grows beyond `maxSize` bytes it is moved to path.1, path.1 to
+// path.2 and so on, keeping `maxFiles` old files.
+func NewAuditLog(path string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultAuditMaxSize
+	}
+	if maxFiles < 0 {
+		maxFiles = 0
+	}
+	a := &AuditLog{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		pending:  make(map[uint32]pendingAudit),
+	}
+	err := a.open()
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("opening audit log %s", a.path))
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return errors.Wrap(err, fmt.Sprintf("checking size of audit log %s", a.path))
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// Close closes the file, requests that weren't answered yet aren't logged
+func (a *AuditLog) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.file.Close()
+}
+
+func (a *AuditLog) OnAppToGateway(app *App, message *comfoconnect.Message) Verdict {
+	if !audited(*message) {
+		return Continue
+	}
+	record := a.newRecord(app, *message)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.expire()
+	if message.Operation.Reference == nil {
+		// there won't be a response to match
+		record.AnsweredBy = "gateway"
+		a.write(record)
+		return Continue
+	}
+	a.pending[message.Operation.GetReference()] = pendingAudit{record: record, started: time.Now()}
+	return Continue
+}
+
+func (a *AuditLog) OnGatewayToApp(message *comfoconnect.Message) Verdict {
+	if isNotification(*message) || message.Operation.Reference == nil {
+		return Continue
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.expire()
+	pending, ok := a.pending[message.Operation.GetReference()]
+	if !ok {
+		return Continue
+	}
+
+	record := pending.record
+	record.Result = message.Operation.GetResult().String()
+	switch response := message.OperationType.(type) {
+	case *proto.CnRmiAsyncConfirm:
+		if message.Operation.GetResult() == proto.GatewayOperation_OK && response.GetResult() == 0 {
+			return Continue // the CnRmiAsyncResponse follows
+		}
+		result := response.GetResult()
+		record.RmiResult = &result
+	case *proto.CnRmiResponse:
+		result := response.GetResult()
+		record.RmiResult = &result
+		record.RmiResponse = hex.EncodeToString(response.GetMessage())
+	case *proto.CnRmiAsyncResponse:
+		result := response.GetResult()
+		record.RmiResult = &result
+		record.RmiResponse = hex.EncodeToString(response.GetMessage())
+	}
+	record.AnsweredBy = "gateway"
+	record.LatencyMs = float64(time.Since(pending.started)) / float64(time.Millisecond)
+	delete(a.pending, message.Operation.GetReference())
+	a.write(record)
+	return Continue
+}
+
+// Local logs a request that the proxy answered itself, like a DeregisterApp or a request that was refused
+func (a *AuditLog) Local(app *App, message comfoconnect.Message, result proto.GatewayOperation_GatewayResult) {
+	if a == nil || !audited(message) {
+		return
+	}
+	record := a.newRecord(app, message)
+	record.Result = result.String()
+	record.AnsweredBy = "proxy"
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if message.Operation.Reference != nil {
+		delete(a.pending, message.Operation.GetReference())
+	}
+	a.write(record)
+}
+
+func (a *AuditLog) newRecord(app *App, message comfoconnect.Message) AuditRecord {
+	return AuditRecord{
+		Time:          time.Now(),
+		AppUUID:       hex.EncodeToString(app.UUID()),
+		DeviceName:    app.DeviceName(),
+		RemoteAddr:    app.conn.RemoteAddr().String(),
+		OperationType: message.Operation.Type.String(),
+		Request:       auditRequest(message),
+	}
+}
+
+// expire logs the requests the gateway didn't answer, like the routes expire. Must be called with the lock held.
+func (a *AuditLog) expire() {
+	for reference, pending := range a.pending {
+		if time.Since(pending.started) > routeTimeout {
+			pending.record.Result = "NO_RESPONSE"
+			pending.record.LatencyMs = float64(time.Since(pending.started)) / float64(time.Millisecond)
+			delete(a.pending, reference)
+			a.write(pending.record)
+		}
+	}
+}
+
+// write appends a record to the file, and rotates it when it's full. Must be called with the lock held.
+func (a *AuditLog) write(record AuditRecord) {
+	log := logrus.WithFields(logrus.Fields{
+		"module": "proxy",
+		"object": "AuditLog",
+		"method": "write",
+		"path":   a.path,
+	})
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		log.Errorf("failed to encode audit record %+v: %v", record, err)
+		return
+	}
+	b = append(b, '\n')
+
+	if a.size > 0 && a.size+int64(len(b)) > a.maxSize {
+		err = a.rotate()
+		if err != nil {
+			log.Errorf("failed to rotate audit log: %v", err)
+		}
+	}
+
+	n, err := a.file.Write(b)
+	a.size += int64(n)
+	if err != nil {
+		log.Errorf("failed to write audit record %s: %v", b, err)
+	}
+}
+
+// rotate moves the files one up, dropping the oldest one. Must be called with the lock held.
+func (a *AuditLog) rotate() error {
+	a.rotation.Lock()
+	defer a.rotation.Unlock()
+
+	err := a.file.Close()
+	if err != nil {
+		return errors.Wrap(err, "closing audit log")
+	}
+	if a.maxFiles == 0 {
+		err = os.Remove(a.path)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, fmt.Sprintf("removing %s", a.path))
+		}
+		return a.open()
+	}
+	for i := a.maxFiles - 1; i >= 1; i-- {
+		err = os.Rename(a.rotatedPath(i), a.rotatedPath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, fmt.Sprintf("moving %s", a.rotatedPath(i)))
+		}
+	}
+	err = os.Rename(a.path, a.rotatedPath(1))
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("moving %s", a.path))
+	}
+	return a.open()
+}
+
+func (a *AuditLog) rotatedPath(i int) string {
+	return fmt.Sprintf("%s.%d", a.path, i)
+}
+
+// AuditQuery selects audit records, fields that aren't set match anything
+type AuditQuery struct {
+	Since         time.Time
+	Until         time.Time
+	App           string // the UUID in hex, or the device name
+	OperationType string
+	Limit         int // only the last records
+}
+
+func (q AuditQuery) matches(record AuditRecord) bool {
+	if !q.Since.IsZero() && record.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && record.Time.After(q.Until) {
+		return false
+	}
+	if q.App != "" && !strings.EqualFold(record.AppUUID, q.App) && record.DeviceName != q.App {
+		return false
+	}
+	if q.OperationType != "" && record.OperationType != q.OperationType {
+		return false
+	}
+	return true
+}
+
+// Query returns the records that match, oldest first, from the current and the rotated files.
+// It doesn't block writing records or rotating the files, it reads from the files as they were when it started.
+func (a *AuditLog) Query(query AuditQuery) ([]AuditRecord, error) {
+	files, err := a.openFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}()
+
+	var records []AuditRecord
+	for _, file := range files {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var record AuditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				continue // a line that was cut off by a crash, or is being written
+			}
+			if query.matches(record) {
+				records = append(records, record)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("reading %s", file.Name()))
+		}
+	}
+
+	if query.Limit > 0 && len(records) > query.Limit {
+		records = records[len(records)-query.Limit:]
+	}
+	return records, nil
+}
+
+// openFiles opens the rotated files and the current one, oldest first. The files are opened together while they can't
+// be moved, a file that is moved after that can still be read from its descriptor.
+func (a *AuditLog) openFiles() ([]*os.File, error) {
+	a.rotation.Lock()
+	defer a.rotation.Unlock()
+
+	var files []*os.File
+	for i := a.maxFiles; i >= 0; i-- {
+		path := a.path
+		if i > 0 {
+			path = a.rotatedPath(i)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			for _, file := range files {
+				_ = file.Close()
+			}
+			return nil, errors.Wrap(err, fmt.Sprintf("opening %s", path))
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// ServeHTTP answers GET requests with the records as a JSON list. The query parameters are since and until
+// (RFC 3339), app, type and limit, see AuditQuery.
+func (a *AuditLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var query AuditQuery
+	var err error
+	values := r.URL.Query()
+	if s := values.Get("since"); s != "" {
+		if query.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, fmt.Sprintf("invalid since: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := values.Get("until"); s != "" {
+		if query.Until, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, fmt.Sprintf("invalid until: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := values.Get("limit"); s != "" {
+		if query.Limit, err = strconv.Atoi(s); err != nil {
+			http.Error(w, fmt.Sprintf("invalid limit: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	query.App = values.Get("app")
+	query.OperationType = values.Get("type")
+
+	records, err := a.Query(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if records == nil {
+		records = []AuditRecord{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(records)
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLogRotateDuringQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// every record rotates the files
+	a, err := NewAuditLog(filepath.Join(dir, "audit.log"), 1, 2)
+	if err != nil {
+		t.Fatalf("creating audit log: %v", err)
+	}
+	defer a.Close()
+	write := func(operationType string) {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		a.write(AuditRecord{Time: time.Now(), OperationType: operationType})
+	}
+	write("first")
+	write("second")
+
+	// the query has opened the files, and is still reading them
+	files, err := a.openFiles()
+	if err != nil {
+		t.Fatalf("opening files: %v", err)
+	}
+
+	written := make(chan bool)
+	go func() {
+		write("third")
+		write("fourth")
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("rotating waited for the query")
+	}
+
+	var read []string
+	for _, file := range files {
+		b, err := ioutil.ReadAll(file)
+		_ = file.Close()
+		if err != nil {
+			t.Fatalf("reading %s: %v", file.Name(), err)
+		}
+		read = append(read, string(b))
+	}
+	if len(read) != 2 {
+		t.Fatalf("query opened %d files, want 2", len(read))
+	}
+	for i, operationType := range []string{"first", "second"} {
+		if want := fmt.Sprintf(`"operation_type":"%s"`, operationType); !strings.Contains(read[i], want) {
+			t.Errorf("file %d of the query is %s, want the %s record", i, read[i], operationType)
+		}
+	}
+
+	records, err := a.Query(AuditQuery{})
+	if err != nil {
+		t.Fatalf("querying after rotating: %v", err)
+	}
+	var got []string
+	for _, record := range records {
+		got = append(got, record.OperationType)
+	}
+	if want := []string{"second", "third", "fourth"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got records %v after rotating, want %v", got, want) // the first one was dropped, there are 2 rotated files
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
@@ -46,7 +47,43 @@ type Client struct {
 	fromGateway chan comfoconnect.Message
 	quit        chan bool
 	exited      chan bool
-	session     *comfoconnect.Session
+
+	// Transparent forwards the bytes as they were received from the apps, see comfoconnect.Message.Forward
+	Transparent bool
+
+	// StateChanges receives true when a session with the gateway is started, and false when it is lost
+	StateChanges chan bool
+
+	lock      sync.Mutex
+	session   *comfoconnect.Session // nil while there is no session
+	previous  *comfoconnect.Session // the session that was lost, its subscriptions are taken over by the next one
+	connected bool
+	pending   []pendingSubscription // changes to the subscriptions while there is no session, in order
+}
+
+const (
+	reconnectMinInterval = time.Second
+	reconnectMaxInterval = time.Minute
+)
+
+// a call to Subscribe, Unsubscribe or UnsubscribeAll without a session, that is replayed when it's started
+type pendingSubscription struct {
+	consumer      string
+	subscriptions []comfoconnect.Subscription // to subscribe to
+	unsubscribe   []uint32                    // the ppids to unsubscribe from
+	all           bool                        // unsubscribe from everything
+}
+
+// apply replays the call on `session`
+func (p pendingSubscription) apply(session *comfoconnect.Session) error {
+	switch {
+	case p.all:
+		return session.UnsubscribeAll(p.consumer)
+	case len(p.unsubscribe) > 0:
+		return session.Unsubscribe(p.consumer, p.unsubscribe...)
+	default:
+		return session.Subscribe(p.consumer, p.subscriptions...)
+	}
 }
 
 func NewClient(ip string, macAddress []byte, toGateway chan comfoconnect.Message, fromGateway chan comfoconnect.Message) *Client {
@@ -63,34 +100,116 @@ func NewClient(ip string, macAddress []byte, toGateway chan comfoconnect.Message
 		uuid:        uuid,
 		toGateway:   toGateway,
 		fromGateway: fromGateway,
+
+		StateChanges: make(chan bool, 10),
 	}
 }
 
-func (c Client) Run(ctx context.Context, wg *sync.WaitGroup) error {
+// Run keeps a session with the gateway, and reconnects when it is lost. While there is no session,
+// Connected returns false, and the change is published on StateChanges.
+func (c *Client) Run(ctx context.Context, wg *sync.WaitGroup) error {
 	log := logrus.WithFields(logrus.Fields{
 		"module": "proxy",
 		"object": "Client",
 		"method": "Run",
 	})
+	defer wg.Done()
 
 	log.Info("starting client")
+	backoff := reconnectMinInterval
+	for {
+		err := c.connect(ctx, wg)
+		if err != nil {
+			log.Errorf("failed to create a session with gateway %s, retrying in %s: %v", c.IP, backoff, err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > reconnectMaxInterval {
+				backoff = reconnectMaxInterval
+			}
+			continue
+		}
+		backoff = reconnectMinInterval
+
+		err = c.serve(ctx)
+		c.setConnected(false)
+		if err == nil {
+			return nil
+		}
+		c.lose()
+		log.Warnf("lost the session with gateway %s, reconnecting: %v", c.IP, err)
+	}
+}
+
+// connect starts a new session, and takes over the subscriptions from the previous one
+func (c *Client) connect(ctx context.Context, wg *sync.WaitGroup) error {
+	log := logrus.WithFields(logrus.Fields{
+		"module": "proxy",
+		"object": "Client",
+		"method": "connect",
+	})
 
 	log.Debugf("starting new session with gateway %s", c.IP)
 	session, err := comfoconnect.NewSession(ctx, wg, c.IP, 0, c.uuid)
 	if err != nil {
-		log.Errorf("failed to create a session with gateway %s: %v", c.IP, err)
-		panic(err)
+		return errors.Wrap(err, "starting session")
+	}
+	c.start(session)
+	c.setConnected(true)
+	return nil
+}
+
+// start makes `session` the current one, with the subscriptions of the lost session and the changes since
+func (c *Client) start(session *comfoconnect.Session) {
+	log := logrus.WithFields(logrus.Fields{
+		"module": "proxy",
+		"object": "Client",
+		"method": "start",
+	})
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.previous != nil {
+		err := session.Resubscribe(c.previous)
+		if err != nil {
+			log.Errorf("failed to take over subscriptions: %v", err)
+		}
+	}
+	for _, pending := range c.pending {
+		err := pending.apply(session)
+		if err != nil {
+			log.Errorf("failed to update subscriptions of %s: %v", pending.consumer, err)
+		}
 	}
-	clientConnected.Set(1)
+	c.pending = nil
+	c.previous = nil
 	c.session = session
+}
+
+// lose drops the session that was lost, so changes to the subscriptions are kept until the next one is started
+func (c *Client) lose() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.previous = c.session
+	c.session = nil
+}
+
+// serve passes messages between the proxy and the session, until the context is done or the session is lost
+func (c *Client) serve(ctx context.Context) error {
+	log := logrus.WithFields(logrus.Fields{
+		"module": "proxy",
+		"object": "Client",
+		"method": "serve",
+	})
 
 	for {
 		select {
 		case <-ctx.Done():
 			log.Info("Shutting down")
 			c.session.Close()
-			clientConnected.Set(0)
-			wg.Done()
 			return nil
 
 		case message := <-c.toGateway:
@@ -103,11 +222,13 @@ func (c Client) Run(ctx context.Context, wg *sync.WaitGroup) error {
 			comfoconnect.SpanSetMessage(span, message)
 			message.Span = span
 
-			message.Src = c.uuid // masquerade
-			message.Dst = c.session.Dst // masquerade
-
 			log.WithField("span", span.Context().(jaeger.SpanContext).String()).Debugf("sending message to gateway: %v", message)
-			err := c.session.Send(message)
+			var err error
+			if c.Transparent {
+				err = c.session.Forward(message)
+			} else {
+				err = c.session.Send(message)
+			}
 			if err != nil {
 				span.SetTag("err", err)
 				log.Errorf("sending message to gateway failed: %v", err)
@@ -120,15 +241,23 @@ func (c Client) Run(ctx context.Context, wg *sync.WaitGroup) error {
 
 			message, err := c.session.Receive()
 			if err != nil {
+				if errors.Cause(err) == comfoconnect.ErrSessionLost {
+					log.Warnf("gateway stopped answering: %v", err)
+					c.session.Close()
+					return err
+				}
 				if errors.Cause(err) == io.EOF {
 					log.Warn("gateway closed connection")
-					clientConnected.Set(0)
+					c.session.Close()
 					return errors.Wrap(err, "lost connection to gateway")
 				}
 				if opError, ok := errors.Cause(err).(*net.OpError); ok {
 					if opError.Timeout() {
 						break // Receive() sets a timeout, so this loop can keep running
 					}
+					log.Warnf("connection to gateway failed: %v", err)
+					c.session.Close()
+					return errors.Wrap(err, "lost connection to gateway")
 				}
 				log.Errorf("got error while receiving from gateway: %v", err)
 				break // restart loop
@@ -152,3 +281,106 @@ func (c Client) Run(ctx context.Context, wg *sync.WaitGroup) error {
 		}
 	}
 }
+
+// Connected returns true while there is a session with the gateway
+func (c *Client) Connected() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.connected
+}
+
+func (c *Client) setConnected(connected bool) {
+	c.lock.Lock()
+	changed := c.connected != connected
+	c.connected = connected
+	c.lock.Unlock()
+
+	if connected {
+		clientConnected.Set(1)
+	} else {
+		clientConnected.Set(0)
+	}
+	if !changed {
+		return
+	}
+	select {
+	case c.StateChanges <- connected:
+	default:
+		logrus.WithFields(logrus.Fields{
+			"module": "proxy",
+			"object": "Client",
+			"method": "setConnected",
+		}).Warn("nobody is reading state changes, dropping")
+	}
+}
+
+// Subscribe requests updates of PDOs on behalf of `consumer`. The subscriptions of all consumers are merged in the session,
+// so the gateway is only asked for PDOs it isn't sending yet. While there is no session, the subscriptions are kept.
+func (c *Client) Subscribe(consumer string, subscriptions ...comfoconnect.Subscription) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.session == nil {
+		c.pending = append(c.pending, pendingSubscription{consumer: consumer, subscriptions: subscriptions})
+		return nil
+	}
+	return c.session.Subscribe(consumer, subscriptions...)
+}
+
+// Unsubscribe drops the subscriptions of `consumer` to `ppids`
+func (c *Client) Unsubscribe(consumer string, ppids ...uint32) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.session == nil {
+		c.pending = append(c.pending, pendingSubscription{consumer: consumer, unsubscribe: ppids})
+		return nil
+	}
+	return c.session.Unsubscribe(consumer, ppids...)
+}
+
+// UnsubscribeAll drops all subscriptions of `consumer`
+func (c *Client) UnsubscribeAll(consumer string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.session == nil {
+		c.pending = append(c.pending, pendingSubscription{consumer: consumer, all: true})
+		return nil
+	}
+	return c.session.UnsubscribeAll(consumer)
+}
+
+// Subscribed returns true when `consumer` is subscribed to `ppid`. While there is no session, that's the subscription
+// of the lost session with the changes since.
+func (c *Client) Subscribed(consumer string, ppid uint32) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.session != nil {
+		return c.session.Subscribed(consumer, ppid)
+	}
+
+	subscribed := c.previous != nil && c.previous.Subscribed(consumer, ppid)
+	for _, pending := range c.pending {
+		if pending.consumer != consumer {
+			continue
+		}
+		switch {
+		case pending.all || containsPpid(pending.unsubscribe, ppid):
+			subscribed = false
+		case len(pending.unsubscribe) == 0:
+			for _, subscription := range pending.subscriptions {
+				if subscription.Ppid == ppid {
+					subscribed = true
+				}
+			}
+		}
+	}
+	return subscribed
+}
+
+func containsPpid(ppids []uint32, ppid uint32) bool {
+	for _, p := range ppids {
+		if p == ppid {
+			return true
+		}
+	}
+	return false
+}
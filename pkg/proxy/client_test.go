@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
+)
+
+// returns a session with a gateway that reads and ignores everything, close the connection when done
+func testSession(t *testing.T) (*comfoconnect.Session, net.Conn) {
+	conn, gateway := net.Pipe()
+	go io.Copy(ioutil.Discard, gateway)
+	return &comfoconnect.Session{Conn: conn}, conn
+}
+
+func TestClientSubscriptionsDuringOutage(t *testing.T) {
+	type subscribed struct {
+		consumer string
+		ppid     uint32
+		want     bool
+	}
+
+	tests := []struct {
+		name   string
+		outage func(c *Client) // the calls while there is no session
+		want   []subscribed
+	}{
+		{
+			name:   "kept from the lost session",
+			outage: func(c *Client) {},
+			want:   []subscribed{{"app", 1, true}, {"app", 2, true}, {"other", 1, false}},
+		},
+		{
+			name: "subscribe",
+			outage: func(c *Client) {
+				c.Subscribe("other", comfoconnect.Subscription{Ppid: 1}, comfoconnect.Subscription{Ppid: 3})
+			},
+			want: []subscribed{{"app", 1, true}, {"other", 1, true}, {"other", 3, true}},
+		},
+		{
+			name: "unsubscribe",
+			outage: func(c *Client) {
+				c.Unsubscribe("app", 1)
+			},
+			want: []subscribed{{"app", 1, false}, {"app", 2, true}},
+		},
+		{
+			name: "unsubscribe all",
+			outage: func(c *Client) {
+				c.UnsubscribeAll("app")
+			},
+			want: []subscribed{{"app", 1, false}, {"app", 2, false}},
+		},
+		{
+			name: "in order",
+			outage: func(c *Client) {
+				c.UnsubscribeAll("app")
+				c.Subscribe("app", comfoconnect.Subscription{Ppid: 2})
+				c.Subscribe("other", comfoconnect.Subscription{Ppid: 4})
+				c.Unsubscribe("other", 4)
+			},
+			want: []subscribed{{"app", 1, false}, {"app", 2, true}, {"other", 4, false}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lost, lostConn := testSession(t)
+			defer lostConn.Close()
+			c := &Client{}
+			c.start(lost)
+			c.Subscribe("app", comfoconnect.Subscription{Ppid: 1}, comfoconnect.Subscription{Ppid: 2})
+
+			c.lose()
+			tt.outage(c)
+			for _, s := range tt.want {
+				if got := c.Subscribed(s.consumer, s.ppid); got != s.want {
+					t.Errorf("during the outage, %s subscribed to %d is %v, want %v", s.consumer, s.ppid, got, s.want)
+				}
+			}
+
+			next, nextConn := testSession(t)
+			defer nextConn.Close()
+			c.start(next)
+			for _, s := range tt.want {
+				if got := next.Subscribed(s.consumer, s.ppid); got != s.want {
+					t.Errorf("in the next session, %s subscribed to %d is %v, want %v", s.consumer, s.ppid, got, s.want)
+				}
+			}
+		})
+	}
+}
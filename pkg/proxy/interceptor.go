@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/uber/jaeger-client-go"
+
+	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
+	"github.com/hsmade/comfoconnectbridge/pkg/instrumentation"
+	"github.com/hsmade/comfoconnectbridge/proto"
+)
+
+// Verdict is what an interceptor decided to do with a message
+type Verdict int
+
+const (
+	Continue Verdict = iota // pass the message on to the next interceptor, changes to it are kept
+	Drop                    // stop here, the message isn't sent anywhere
+	Answered                // the interceptor answered the app itself, see App.Respond, the message isn't forwarded
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case Continue:
+		return "continue"
+	case Drop:
+		return "drop"
+	case Answered:
+		return "answered"
+	}
+	return fmt.Sprintf("Verdict(%d)", int(v))
+}
+
+// Interceptor sees the messages that pass through the proxy, in the order the interceptors were added with Proxy.Use.
+// The message can be changed in place. In transparent mode a changed message is encoded again, instead of forwarding the
+// bytes as they were received. The hooks are called from the main loop of the proxy, so they shouldn't block.
+type Interceptor interface {
+	// OnAppToGateway is called for a message from an app, before it is forwarded to the gateway.
+	// CnRpdoRequests pass here too, before the proxy merges them with the subscriptions of the other apps.
+	OnAppToGateway(app *App, message *comfoconnect.Message) Verdict
+	// OnGatewayToApp is called for a message from the gateway, before it is sent to the apps.
+	// Answered is handled like Drop here, there's no app to answer.
+	OnGatewayToApp(message *comfoconnect.Message) Verdict
+}
+
+var interceptedCount = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "comfoconnect_proxy_intercepted_total",
+		Help: "Number of messages that an interceptor dropped or answered.",
+	},
+	[]string{"interceptor", "direction", "verdict"},
+)
+
+// Use adds interceptors to the end of the chain. Call before Run.
+func (p *Proxy) Use(interceptors ...Interceptor) {
+	p.interceptors = append(p.interceptors, interceptors...)
+}
+
+// interceptAppToGateway runs the chain for a message from an app, and returns whether it should be forwarded
+func (p Proxy) interceptAppToGateway(app *App, message *comfoconnect.Message) bool {
+	defer keepChanges(message)()
+	for _, interceptor := range p.interceptors {
+		verdict := interceptor.OnAppToGateway(app, message)
+		if verdict != Continue {
+			p.intercepted(interceptor, "app_to_gateway", verdict, *message)
+			return false
+		}
+	}
+	return true
+}
+
+// interceptGatewayToApp runs the chain for a message from the gateway, and returns whether it should be sent to the apps
+func (p Proxy) interceptGatewayToApp(message *comfoconnect.Message) bool {
+	defer keepChanges(message)()
+	for _, interceptor := range p.interceptors {
+		verdict := interceptor.OnGatewayToApp(message)
+		if verdict != Continue {
+			p.intercepted(interceptor, "gateway_to_app", verdict, *message)
+			return false
+		}
+	}
+	return true
+}
+
+// keepChanges returns a func that drops the received bytes of the message when it was changed since, so
+// comfoconnect.Message.Forward encodes the changes instead of forwarding the bytes as they were received
+func keepChanges(message *comfoconnect.Message) func() {
+	if message.RawMessage == nil {
+		return func() {}
+	}
+	before := message.Encode()
+	return func() {
+		if !bytes.Equal(before, message.Encode()) {
+			message.RawMessage = nil
+		}
+	}
+}
+
+func (p Proxy) intercepted(interceptor Interceptor, direction string, verdict Verdict, message comfoconnect.Message) {
+	name := fmt.Sprintf("%T", interceptor)
+	logrus.WithFields(logrus.Fields{
+		"module":      "proxy",
+		"object":      "Proxy",
+		"method":      "intercepted",
+		"interceptor": name,
+		"direction":   direction,
+	}).Debugf("%s was stopped with verdict %s", message.Operation.Type.String(), verdict)
+	interceptedCount.WithLabelValues(name, direction, verdict.String()).Inc()
+}
+
+// metricsInterceptor keeps State and the metrics up to date with the messages that pass, it's the first of the chain
+type metricsInterceptor struct {
+	state *comfoconnect.StateStore
+}
+
+func (m metricsInterceptor) OnAppToGateway(app *App, message *comfoconnect.Message) Verdict {
+	m.generateMetrics(*message)
+	return Continue
+}
+
+func (m metricsInterceptor) OnGatewayToApp(message *comfoconnect.Message) Verdict {
+	m.generateMetrics(*message)
+	return Continue
+}
+
+func (m metricsInterceptor) generateMetrics(message comfoconnect.Message) {
+	span := opentracing.GlobalTracer().StartSpan("proxy.generateMetrics", opentracing.ChildOf(message.Span.Context()))
+	comfoconnect.SpanSetMessage(span, message)
+	defer span.Finish()
+
+	log := logrus.WithFields(logrus.Fields{
+		"module": "proxy",
+		"method": "generateMetrics",
+		"span":   span.Context().(jaeger.SpanContext).String(),
+	})
+
+	m.state.Update(message)
+
+	switch message.Operation.Type.String() {
+	case "CnRpdoNotificationType":
+		conv := message.DecodePDO()
+		if err := conv.Validate(); err != nil {
+			log.Warnf("ignoring invalid RPDO: %v", err)
+			break
+		}
+		instrumentation.UpdateEnergyMetrics(message.OperationType.(*proto.CnRpdoNotification).GetPdid(), conv)
+	case "CnAlarmNotificationType":
+		log.Warnf("Got alarm notification: %v", message)
+	}
+	log.Debugf("called for %v", message)
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
+	"github.com/hsmade/comfoconnectbridge/proto"
+)
+
+// changes the node of CnRmiRequests to 2
+type nodeInterceptor struct{}
+
+func (nodeInterceptor) OnAppToGateway(app *App, message *comfoconnect.Message) Verdict {
+	if request, ok := message.OperationType.(*proto.CnRmiRequest); ok {
+		request.NodeId = uint32Pointer(2)
+	}
+	return Continue
+}
+
+func (nodeInterceptor) OnGatewayToApp(message *comfoconnect.Message) Verdict {
+	return Continue
+}
+
+func TestInterceptorChangesAreForwarded(t *testing.T) {
+	src := bytes.Repeat([]byte{0x01}, 16)
+
+	tests := []struct {
+		name      string
+		operation proto.GatewayOperation_OperationType
+		request   comfoconnect.OperationType
+		wantRaw   bool // whether the received bytes are still forwarded
+		wantNode  uint32
+	}{
+		{
+			name:      "changed",
+			operation: proto.GatewayOperation_CnRmiRequestType,
+			request:   &proto.CnRmiRequest{NodeId: uint32Pointer(1), Message: []byte{0x01, 0x1d, 0x01}},
+			wantNode:  2,
+		},
+		{
+			name:      "unchanged",
+			operation: proto.GatewayOperation_VersionRequestType,
+			request:   &proto.VersionRequest{},
+			wantRaw:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := Proxy{interceptors: []Interceptor{nodeInterceptor{}}}
+			message := appRequest(t, src, tt.operation, tt.request)
+			if !p.interceptAppToGateway(nil, &message) {
+				t.Fatal("message wasn't forwarded")
+			}
+			if raw := message.RawMessage != nil; raw != tt.wantRaw {
+				t.Errorf("received bytes are kept: %v, want %v", raw, tt.wantRaw)
+			}
+
+			forwarded := receive(t, message.Forward())
+			if request, ok := forwarded.OperationType.(*proto.CnRmiRequest); ok && request.GetNodeId() != tt.wantNode {
+				t.Errorf("forwarded to node %d, want %d", request.GetNodeId(), tt.wantNode)
+			}
+		})
+	}
+}
@@ -1,10 +1,13 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/opentracing/opentracing-go"
@@ -45,16 +48,67 @@ var (
 		},
 		[]string{"message_type"},
 	)
+	appQueueLength = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "comfoconnect_proxy_app_queue_length",
+			Help: "The current number of messages waiting to be written to an app.",
+		},
+		[]string{"app"},
+	)
+	appDroppedCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "comfoconnect_proxy_app_dropped_total",
+			Help: "Number of notifications dropped because the queue of an app was full.",
+		},
+		[]string{"app"},
+	)
+	appOverflowDisconnects = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "comfoconnect_proxy_app_overflow_disconnects_total",
+			Help: "Number of apps that were disconnected because their queue was full.",
+		},
+	)
 )
 
+// how long a write to an app may take before the app is disconnected
+const appWriteTimeout = 10 * time.Second
+
 type Listener struct {
 	listener  *net.TCPListener
 
-	apps      map[string]*App
-	toGateway chan comfoconnect.Message
+	lock      sync.Mutex
+	apps      *AppRegistry
+	router    *router
+	toGateway chan appMessage
+
+	subscriptions chan appMessage // CnRpdoRequests, which the proxy handles itself
+	left          chan *App       // apps that disconnected
+	offline       bool            // the gateway is unreachable
+
+	// the size of the outbound queue of each app, and what to do when it's full. Set before Run.
+	QueueSize int
+	Overflow  OverflowPolicy
+
+	// Transparent forwards the bytes as they were received from the gateway, see comfoconnect.Message.Forward
+	Transparent bool
+
+	// Registrations are the apps that may start a session. Set before Run.
+	Registrations *Registrations
+
+	// Policies decide what apps may send to the gateway, nil allows everything. Set before Run.
+	Policies *Policies
+
+	// Audit logs the state-changing requests the proxy answers itself, nil doesn't log. Set before Run.
+	Audit *AuditLog
 }
 
-func NewListener(toGateway chan comfoconnect.Message) *Listener {
+// appMessage is a message from an app, with the app so the proxy knows who sent it
+type appMessage struct {
+	app     *App
+	message comfoconnect.Message
+}
+
+func NewListener(toGateway chan appMessage) *Listener {
 	log := logrus.WithFields(logrus.Fields{
 		"module": "proxy",
 		"method": "NewListener",
@@ -75,11 +129,70 @@ func NewListener(toGateway chan comfoconnect.Message) *Listener {
 	prometheus.MustRegister(messageSentCount)
 	prometheus.MustRegister(messageReceiverCount)
 	prometheus.MustRegister(messageReceivedCount)
+	prometheus.MustRegister(appQueueLength)
+	prometheus.MustRegister(appDroppedCount)
+	prometheus.MustRegister(appOverflowDisconnects)
+	apps := newAppRegistry()
+	prometheus.MustRegister(apps)
 	return &Listener{
 
 		listener:  listener,
 		toGateway: toGateway,
-		apps:      make(map[string]*App),
+		apps:      apps,
+		router:    newRouter(),
+
+		subscriptions: make(chan appMessage, 500),
+		left:          make(chan *App, 10),
+		offline:       true, // until the client has a session
+
+		QueueSize: DefaultQueueSize,
+		Overflow:  OverflowDropOldest,
+
+		Registrations: &Registrations{apps: make(map[string]RegisteredApp)}, // PIN 0, in memory
+	}
+}
+
+// Apps returns the apps that are currently connected
+func (l *Listener) Apps() []*App {
+	return l.apps.List()
+}
+
+// SessionApps returns the connected apps that started a session, the others don't get notifications
+func (l *Listener) SessionApps() []*App {
+	var apps []*App
+	for _, app := range l.apps.List() {
+		if app.State() == AppSession {
+			apps = append(apps, app)
+		}
+	}
+	return apps
+}
+
+// Registry returns the registry of the connected apps
+func (l *Listener) Registry() *AppRegistry {
+	return l.apps
+}
+
+// SetOnline tells the listener whether the gateway is reachable, which is announced to apps that start a session
+func (l *Listener) SetOnline(online bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.offline = !online
+}
+
+func (l *Listener) online() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return !l.offline
+}
+
+func (l *Listener) removeApp(ctx context.Context, app *App) {
+	l.apps.remove(app)
+	app.Close()
+	l.router.forget(app)
+	select {
+	case l.left <- app:
+	case <-ctx.Done(): // the proxy stopped, there are no subscriptions to drop
 	}
 }
 
@@ -120,16 +233,27 @@ func (l *Listener) Run(ctx context.Context, wg *sync.WaitGroup) {
 			log.Infof("got a new connection from: %s", conn.RemoteAddr().String())
 			handlers.Add(1)
 			go func() {
-				for {
-					app := App{conn: conn}
-					l.apps[conn.RemoteAddr().String()] = &app
-					log.Debug("starting handler")
-					err := app.HandleConnection(ctx, wg, l.toGateway)
-					if err != nil {
-						log.Errorf("failed to handle connection: %v", err)
-						break
-					}
+				app := &App{
+					conn:          conn,
+					router:        l.router,
+					subscriptions: l.subscriptions,
+					online:        l.online,
+					outbox:        newOutbox(l.QueueSize, l.Overflow),
+					transparent:   l.Transparent,
+					registrations: l.Registrations,
+					policies:      l.Policies,
+					audit:         l.Audit,
+					connected:     time.Now(),
 				}
+				go app.writer()
+				l.apps.add(app)
+				log.Debug("starting handler")
+				err := app.HandleConnection(ctx, l.toGateway)
+				if err != nil {
+					log.Errorf("failed to handle connection: %v", err)
+				}
+				// also when shutting down, so the connection is closed and the writer stops
+				l.removeApp(ctx, app)
 				handlers.Done()
 				clientConnections.Dec()
 			}()
@@ -138,11 +262,56 @@ func (l *Listener) Run(ctx context.Context, wg *sync.WaitGroup) {
 }
 
 type App struct {
-	uuid []byte
-	conn net.Conn
+	// counters for AppInfo, first for the alignment of atomic operations
+	received uint64
+	sent     uint64
+	dropped  uint64
+
+	uuidLock      sync.Mutex
+	uuid          []byte
+	conn          net.Conn
+	router        *router
+	subscriptions chan appMessage
+	online        func() bool
+	outbox        *outbox
+	closeOnce     sync.Once
+	transparent   bool
+
+	registrations  *Registrations
+	policies       *Policies
+	audit          *AuditLog
+	sessionStarted bool   // only touched by HandleConnection
+	registered     []byte // the UUID that registered with the PIN on this connection, only touched by HandleConnection
+
+	connected time.Time
+	state     atomic.Value // AppState
+}
+
+// ID identifies the app, as a consumer of subscriptions
+func (a *App) ID() string {
+	return "app/" + a.conn.RemoteAddr().String()
+}
+
+// UUID is the UUID the app started its session with, nil before that
+func (a *App) UUID() []byte {
+	a.uuidLock.Lock()
+	defer a.uuidLock.Unlock()
+	return a.uuid
+}
+
+func (a *App) setUUID(uuid []byte) {
+	a.uuidLock.Lock()
+	defer a.uuidLock.Unlock()
+	a.uuid = uuid
+}
+
+// DeviceName is the name the app registered with, if it did
+func (a *App) DeviceName() string {
+	registration, _ := a.registrations.Get(a.UUID())
+	return registration.DeviceName
 }
 
-func (a *App) HandleConnection(ctx context.Context, wg *sync.WaitGroup, gateway chan comfoconnect.Message) error {
+func (a *App) HandleConnection(ctx context.Context, gateway chan appMessage) error {
 	log := logrus.WithFields(logrus.Fields{
 		"module": "proxy",
 		"object": "listener",
@@ -152,6 +321,7 @@ func (a *App) HandleConnection(ctx context.Context, wg *sync.WaitGroup, gateway
 	log.Infof("handling connection from: %s", a.conn.RemoteAddr().String())
 
 	messageChannel := make(chan comfoconnect.Message, 500)
+	disconnected := make(chan bool)
 	//prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
 	//	Name: "comfoconnect_proxy_listener_messageChannel_queue",
 	//	Help: "The current number of items on messageChannel queue.",
@@ -159,13 +329,12 @@ func (a *App) HandleConnection(ctx context.Context, wg *sync.WaitGroup, gateway
 	//	return float64(len(messageChannel))
 	//}))
 
-	go func (ctx context.Context, wg *sync.WaitGroup, messageChannel chan comfoconnect.Message) {
+	go func (ctx context.Context, messageChannel chan comfoconnect.Message) {
 		log.Debug("starting socket reader")
 		for {
 			select {
 			case <- ctx.Done():
 				log.Debug("closing connection reader go-func")
-				wg.Done()
 				return
 			default:
 				err := a.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 300))
@@ -176,6 +345,12 @@ func (a *App) HandleConnection(ctx context.Context, wg *sync.WaitGroup, gateway
 				message, err := comfoconnect.GetMessageFromSocket(a.conn)
 				if err != nil {
 					if errors.Cause(err) == io.EOF {
+						close(disconnected)
+						return
+					}
+					if opErr, ok := errors.Cause(err).(*net.OpError); ok && !opErr.Timeout() {
+						// closed by us, or broken
+						close(disconnected)
 						return
 					}
 					// FIXME: log error, ignore timeout
@@ -185,28 +360,29 @@ func (a *App) HandleConnection(ctx context.Context, wg *sync.WaitGroup, gateway
 				messageChannel <- message
 			}
 		}
-	}(ctx, wg, messageChannel)
+	}(ctx, messageChannel)
 
 	log.Debug("starting main loop")
 	for {
 		select {
 		case <- ctx.Done():
 			log.Debug("closing main loop")
-			wg.Done()
 			return nil
+		case <-disconnected:
+			return errors.New("app disconnected")
 		case message := <- messageChannel:
 			messageReceivedCount.WithLabelValues(message.Operation.Type.String()).Inc()
 			span := opentracing.GlobalTracer().StartSpan("proxy.App.HandleConnection.ReceivedMessage", opentracing.ChildOf(message.Span.Context()))
 			comfoconnect.SpanSetMessage(span, message)
 			log.WithField("span",span.Context().(jaeger.SpanContext).String()).Debugf("got a message from app(%s): %v", a.conn.RemoteAddr(), message)
-			a.uuid = message.Src
+			atomic.AddUint64(&a.received, 1)
 			a.handleMessage(message, gateway)
 			span.Finish()
 		}
 	}
 }
 
-func (a *App) handleMessage(message comfoconnect.Message, gateway chan comfoconnect.Message) {
+func (a *App) handleMessage(message comfoconnect.Message, gateway chan appMessage) {
 	span := opentracing.GlobalTracer().StartSpan("proxy.App.HandleConnection.handleMessage", opentracing.ChildOf(message.Span.Context()))
 	comfoconnect.SpanSetMessage(span, message)
 
@@ -217,18 +393,55 @@ func (a *App) handleMessage(message comfoconnect.Message, gateway chan comfoconn
 		"span": span.Context().(jaeger.SpanContext).String(),
 	})
 
+	// the UUID is set once, by StartSession. Another Src would get the policy of another app.
+	if uuid := a.UUID(); uuid != nil && !bytes.Equal(message.Src, uuid) {
+		a.refuse(message, span, "Src isn't the UUID the session was started with")
+		span.Finish()
+		return
+	}
+
 	switch message.Operation.Type.String() {
 	case "RegisterAppRequestType":
 		log.Debug("responding to RegisterAppRequestType")
-		a.uuid = message.Src
-		_, err := a.conn.Write(message.CreateResponse(span, proto.GatewayOperation_OK))
+		request := message.OperationType.(*proto.RegisterAppRequest)
+		status := proto.GatewayOperation_OK
+		var err error
+		if !bytes.Equal(request.GetUuid(), message.Src) {
+			log.Warnf("app(%s) %s tried to register another UUID than its own", a.conn.RemoteAddr(), request.GetDevicename())
+			status = proto.GatewayOperation_NOT_ALLOWED
+		} else if err = a.registrations.Register(request.GetUuid(), request.GetDevicename(), request.GetPin()); err == ErrWrongPin {
+			log.Warnf("app(%s) %s tried to register with the wrong PIN", a.conn.RemoteAddr(), request.GetDevicename())
+			status = proto.GatewayOperation_NOT_ALLOWED
+		} else if err != nil {
+			log.Errorf("failed to store registration of %s: %v", request.GetDevicename(), err)
+		}
+		if status == proto.GatewayOperation_OK {
+			a.registered = request.GetUuid()
+			if a.State() == AppConnected {
+				a.setState(AppRegistered)
+			}
+		}
+		err = a.send(message.CreateResponse(span, status), "RegisterAppConfirmType")
 		if err != nil {
 			span.SetTag("err", err)
 			log.Warnf("failed to write response for RegisterAppRequestType: %v", err)
 		}
 	case "StartSessionRequestType":
 		log.Debug("responding to StartSessionRequestType")
-		_, err := a.conn.Write(message.CreateResponse(span, proto.GatewayOperation_OK))
+		// an app that registered on this connection can only start a session for that registration
+		if !a.registrations.Registered(message.Src) || (a.registered != nil && !bytes.Equal(a.registered, message.Src)) {
+			log.Warnf("app(%s) isn't registered, refusing session", a.conn.RemoteAddr())
+			err := a.send(message.CreateResponse(span, proto.GatewayOperation_NOT_ALLOWED), "StartSessionConfirmType")
+			if err != nil {
+				span.SetTag("err", err)
+				log.Warnf("failed to write response for StartSessionRequestType: %v", err)
+			}
+			break
+		}
+		a.setUUID(message.Src)
+		a.sessionStarted = true
+		a.setState(AppSession)
+		err := a.send(message.CreateResponse(span, proto.GatewayOperation_OK), "StartSessionConfirmType")
 		if err != nil {
 			span.SetTag("err", err)
 			log.Warnf("failed to write response for StartSessionRequestType: %v", err)
@@ -242,49 +455,245 @@ func (a *App) handleMessage(message comfoconnect.Message, gateway chan comfoconn
 			ZoneId:    &i,
 			Mode:      &mode,
 		}
-		_, err = a.conn.Write(message.CreateCustomResponse(span, proto.GatewayOperation_CnNodeNotificationType, &notification))
+		err = a.send(message.CreateCustomResponse(span, proto.GatewayOperation_CnNodeNotificationType, &notification), "CnNodeNotificationType")
 		if err != nil {
 			span.SetTag("err", err)
 			log.Warnf("failed to write CnNodeNotification-1: %v", err)
 		}
 
-		i48 := uint32(48)
-		i5 := uint32(5)
-		i255 := uint32(255)
-		mode = proto.CnNodeNotification_NODE_NORMAL
-		notification = proto.CnNodeNotification{
-			NodeId:    &i48,
-			ProductId: &i5,
-			ZoneId:    &i255,
-			Mode:      &mode,
-		}
-		_, err = a.conn.Write(message.CreateCustomResponse(span, proto.GatewayOperation_CnNodeNotificationType, &notification))
+		err = a.send(message.CreateCustomResponse(span, proto.GatewayOperation_CnNodeNotificationType, ventilationNodeNotification(a.online())), "CnNodeNotificationType")
 		if err != nil {
 			span.SetTag("err", err)
 			log.Warnf("failed to write CnNodeNotification-2: %v", err)
 		}
 
+	case "ListRegisteredAppsRequestType":
+		// the UUIDs are what apps start a session with, so only apps with a session get to see them
+		if !a.sessionStarted {
+			a.refuse(message, span, "the app didn't start a session")
+			break
+		}
+		log.Debug("responding to ListRegisteredAppsRequestType")
+		confirm := proto.ListRegisteredAppsConfirm{}
+		for _, app := range a.registrations.List() {
+			deviceName := app.DeviceName
+			confirm.Apps = append(confirm.Apps, &proto.ListRegisteredAppsConfirm_App{
+				Uuid:       app.UUID,
+				Devicename: &deviceName,
+			})
+		}
+		response := message
+		response.Src = message.Dst
+		response.Dst = message.Src
+		err := a.send(response.CreateCustomResponse(span, proto.GatewayOperation_ListRegisteredAppsConfirmType, &confirm), "ListRegisteredAppsConfirmType")
+		if err != nil {
+			span.SetTag("err", err)
+			log.Warnf("failed to write response for ListRegisteredAppsRequestType: %v", err)
+		}
+
+	case "DeregisterAppRequestType":
+		if err := a.checkPolicy(message); err != nil {
+			a.refuse(message, span, err.Error())
+			break
+		}
+		log.Debug("responding to DeregisterAppRequestType")
+		status := proto.GatewayOperation_OK
+		if !a.sessionStarted {
+			status = proto.GatewayOperation_NOT_ALLOWED
+		} else {
+			request := message.OperationType.(*proto.DeregisterAppRequest)
+			err := a.registrations.Deregister(request.GetUuid())
+			if err != nil {
+				log.Errorf("failed to store the deregistration: %v", err)
+			}
+		}
+		a.audit.Local(a, message, status)
+		err := a.send(message.CreateResponse(span, status), "DeregisterAppConfirmType")
+		if err != nil {
+			span.SetTag("err", err)
+			log.Warnf("failed to write response for DeregisterAppRequestType: %v", err)
+		}
+
+	case "CloseSessionRequestType":
+		// the session with the gateway is the proxy's, only end the one of the app
+		log.Debug("responding to CloseSessionRequestType")
+		a.sessionStarted = false
+		a.setState(AppRegistered)
+		err := a.send(message.CreateResponse(span, proto.GatewayOperation_OK), "CloseSessionConfirmType")
+		if err != nil {
+			span.SetTag("err", err)
+			log.Warnf("failed to write response for CloseSessionRequestType: %v", err)
+		}
+
+	case "CnRpdoRequestType":
+		if !a.sessionStarted {
+			a.refuse(message, span, "the app didn't start a session")
+			break
+		}
+		if err := a.checkPolicy(message); err != nil {
+			a.refuse(message, span, err.Error())
+			break
+		}
+		log.Debugf("passing subscription to proxy: %v", message)
+		message.Span = span
+		a.subscriptions <- appMessage{app: a, message: message}
+
 	default:
+		if !a.sessionStarted {
+			a.refuse(message, span, "the app didn't start a session")
+			break
+		}
+		if err := a.checkPolicy(message); err != nil {
+			a.refuse(message, span, err.Error())
+			break
+		}
+		a.router.register(a, &message)
 		log.Debugf("forwarding message to gateway: %v", message)
 		message.Span = span
-		gateway <- message
+		gateway <- appMessage{app: a, message: message}
 	}
 	span.Finish()
 }
 
-func (a *App) Write(message comfoconnect.Message) error {
+// checkPolicy returns an error when the policy of the app doesn't allow the message
+func (a *App) checkPolicy(message comfoconnect.Message) error {
+	if a.policies == nil {
+		return nil
+	}
+	return a.policies.For(a.UUID(), a.DeviceName()).Check(message)
+}
+
+// refuse answers a message from an app with NOT_ALLOWED
+func (a *App) refuse(message comfoconnect.Message, span opentracing.Span, reason string) {
 	log := logrus.WithFields(logrus.Fields{
 		"module": "proxy",
 		"object": "App",
-		"method": "Write",
+		"method": "refuse",
+		"app":    a.ID(),
 	})
-	messageSentCount.WithLabelValues(message.Operation.Type.String()).Inc()
-	span := opentracing.GlobalTracer().StartSpan("proxy.App.Write")
+	log.Warnf("refusing %s: %s", message.Operation.Type.String(), reason)
+	a.audit.Local(a, message, proto.GatewayOperation_NOT_ALLOWED)
+	if message.Operation.Type.String() == "KeepAliveType" {
+		return
+	}
+	err := a.send(message.CreateResponse(span, proto.GatewayOperation_NOT_ALLOWED), message.Operation.Type.String())
+	if err != nil {
+		span.SetTag("err", err)
+		log.Warnf("failed to refuse %s: %v", message.Operation.Type.String(), err)
+	}
+}
+
+// Write queues a message for the app, it returns an error when the app is disconnected
+func (a *App) Write(message comfoconnect.Message) error {
+	span := opentracing.GlobalTracer().StartSpan("proxy.App.Write", opentracing.ChildOf(message.Span.Context()))
 	comfoconnect.SpanSetMessage(span, message)
 	defer span.Finish()
-	e := message.Encode()
-	length, err := a.conn.Write(e)
-	log.Infof("Wrote %d bytes to app. err:%v bytes:%x message:%v", length, err, e, message)
-	span.SetTag("length", length)
-	return err
+	if a.transparent {
+		return a.send(message.Forward(), message.Operation.Type.String())
+	}
+	return a.send(message.Encode(), message.Operation.Type.String())
+}
+
+// Respond answers a request of the app with `status`, without involving the gateway.
+// It's meant for interceptors, which get the request with the reference the proxy gave it.
+func (a *App) Respond(request comfoconnect.Message, status proto.GatewayOperation_GatewayResult) error {
+	a.router.resolve(&request) // back to the reference of the app
+	response := request.CreateResponse(request.Span, status)
+	if response == nil {
+		return errors.New(fmt.Sprintf("no response for %s", request.Operation.Type.String()))
+	}
+	return a.send(response, request.Operation.Type.String())
+}
+
+// send queues an encoded message for the app. When the queue is full, the overflow policy applies.
+func (a *App) send(data []byte, operationType string) error {
+	if data == nil {
+		return errors.New(fmt.Sprintf("no %s to send", operationType))
+	}
+	dropped, result := a.outbox.push(outbound{
+		data:          data,
+		operationType: operationType,
+		notification:  operationType == "CnRpdoNotificationType",
+	})
+	if dropped > 0 {
+		atomic.AddUint64(&a.dropped, uint64(dropped))
+		appDroppedCount.WithLabelValues(a.ID()).Add(float64(dropped))
+	}
+	switch result {
+	case pushClosed:
+		return errors.New("app is disconnected")
+	case pushFull:
+		logrus.WithFields(logrus.Fields{
+			"module": "proxy",
+			"object": "App",
+			"method": "send",
+			"app":    a.ID(),
+		}).Warn("queue is full, disconnecting app")
+		appOverflowDisconnects.Inc()
+		a.Close()
+		return errors.New("app is disconnected")
+	}
+	appQueueLength.WithLabelValues(a.ID()).Set(float64(a.outbox.len()))
+	return nil
+}
+
+// writer writes the queued messages to the app, until the app is closed
+func (a *App) writer() {
+	log := logrus.WithFields(logrus.Fields{
+		"module": "proxy",
+		"object": "App",
+		"method": "writer",
+		"app":    a.ID(),
+	})
+
+	for {
+		item, ok := a.outbox.pop()
+		if !ok {
+			log.Debug("app is closed, stopping writer")
+			return
+		}
+		appQueueLength.WithLabelValues(a.ID()).Set(float64(a.outbox.len()))
+
+		err := a.conn.SetWriteDeadline(time.Now().Add(appWriteTimeout))
+		if err != nil {
+			log.Warnf("failed to set writeDeadline: %v", err)
+		}
+		length, err := a.conn.Write(item.data)
+		log.Infof("Wrote %d bytes to app. err:%v bytes:%x type:%s", length, err, item.data, item.operationType)
+		if err != nil {
+			log.Errorf("failed to write to app, disconnecting: %v", err)
+			a.Close()
+			return
+		}
+		messageSentCount.WithLabelValues(item.operationType).Inc()
+		atomic.AddUint64(&a.sent, 1)
+	}
+}
+
+// Close disconnects the app, and drops what's still queued for it
+func (a *App) Close() {
+	a.closeOnce.Do(func() {
+		a.setState(AppClosed)
+		a.outbox.close()
+		_ = a.conn.Close()
+		appQueueLength.DeleteLabelValues(a.ID())
+		appDroppedCount.DeleteLabelValues(a.ID())
+	})
+}
+
+// ventilationNodeNotification announces the ventilation unit, as offline when the gateway can't be reached
+func ventilationNodeNotification(online bool) *proto.CnNodeNotification {
+	i48 := uint32(48)
+	i5 := uint32(5)
+	i255 := uint32(255)
+	mode := proto.CnNodeNotification_NODE_NORMAL
+	if !online {
+		mode = proto.CnNodeNotification_NODE_OFFLINE
+	}
+	return &proto.CnNodeNotification{
+		NodeId:    &i48,
+		ProductId: &i5,
+		ZoneId:    &i255,
+		Mode:      &mode,
+	}
 }
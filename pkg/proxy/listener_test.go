@@ -0,0 +1,331 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	jaeger "github.com/uber/jaeger-client-go"
+
+	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
+	"github.com/hsmade/comfoconnectbridge/proto"
+)
+
+func TestMain(m *testing.M) {
+	// the proxy logs the jaeger span of every message
+	tracer, closer := jaeger.NewTracer("test", jaeger.NewConstSampler(true), jaeger.NewNullReporter())
+	opentracing.SetGlobalTracer(tracer)
+	code := m.Run()
+	closer.Close()
+	os.Exit(code)
+}
+
+// receive decodes a frame like the app's connection does
+func receive(t *testing.T, frame []byte) comfoconnect.Message {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	go other.Write(frame)
+	message, err := comfoconnect.GetMessageFromSocket(conn)
+	if err != nil {
+		t.Fatalf("decoding frame: %v", err)
+	}
+	return message
+}
+
+// unknownFrame returns a frame with an operation type that isn't in zehnder.proto
+func unknownFrame(reference uint32) []byte {
+	operationType := proto.GatewayOperation_OperationType(200)
+	operation := proto.GatewayOperation{Type: &operationType, Reference: &reference}
+	operationBytes, _ := operation.XXX_Marshal(nil, false)
+	body := []byte{0x0a, 0x01, 0x01} // some field of the unknown type
+
+	frame := make([]byte, 4)
+	binary.BigEndian.PutUint32(frame, uint32(34+len(operationBytes)+len(body)))
+	frame = append(frame, bytes.Repeat([]byte{0x01}, 16)...) // app
+	frame = append(frame, bytes.Repeat([]byte{0x02}, 16)...) // proxy
+	frame = append(frame, byte(len(operationBytes)>>8), byte(len(operationBytes)))
+	frame = append(frame, operationBytes...)
+	return append(frame, body...)
+}
+
+// appRequest returns a request from the app with `src`, decoded like the app's connection does
+func appRequest(t *testing.T, src []byte, operationType proto.GatewayOperation_OperationType, request comfoconnect.OperationType) comfoconnect.Message {
+	message := comfoconnect.Message{
+		Src:           src,
+		Dst:           bytes.Repeat([]byte{0x02}, 16),
+		Operation:     proto.GatewayOperation{Type: operationType.Enum(), Reference: uint32Pointer(5)},
+		OperationType: request,
+	}
+	return receive(t, message.Encode())
+}
+
+// handshakeApp returns an app that isn't registered yet, with `registrations`
+func handshakeApp(t *testing.T, registrations *Registrations) *App {
+	app := testApp(t)
+	app.router = newRouter()
+	app.outbox = newOutbox(10, OverflowDropOldest)
+	app.registrations = registrations
+	app.online = func() bool { return true }
+	return app
+}
+
+// handle passes `message` to the app, and returns the first response queued for it, and whether it was forwarded
+func handle(t *testing.T, app *App, message comfoconnect.Message) (*comfoconnect.Message, bool) {
+	gateway := make(chan appMessage, 1)
+	app.handleMessage(message, gateway)
+
+	var response *comfoconnect.Message
+	if app.outbox.len() > 0 {
+		item, _ := app.outbox.pop()
+		decoded := receive(t, item.data)
+		response = &decoded
+		for app.outbox.len() > 0 {
+			app.outbox.pop() // the notifications after a StartSessionConfirm
+		}
+	}
+	select {
+	case <-gateway:
+		return response, true
+	default:
+		return response, false
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	const pin = 4321
+	phone := bytes.Repeat([]byte{0x01}, 16)
+	tablet := bytes.Repeat([]byte{0x03}, 16)
+
+	register := func(src, uuid []byte, pin uint32) comfoconnect.Message {
+		deviceName := "tablet"
+		return appRequest(t, src, proto.GatewayOperation_RegisterAppRequestType, &proto.RegisterAppRequest{Uuid: uuid, Pin: &pin, Devicename: &deviceName})
+	}
+	startSession := func(src []byte) comfoconnect.Message {
+		return appRequest(t, src, proto.GatewayOperation_StartSessionRequestType, &proto.StartSessionRequest{})
+	}
+	list := func(src []byte) comfoconnect.Message {
+		return appRequest(t, src, proto.GatewayOperation_ListRegisteredAppsRequestType, &proto.ListRegisteredAppsRequest{})
+	}
+
+	type step struct {
+		message    comfoconnect.Message
+		wantResult proto.GatewayOperation_GatewayResult
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name:  "registered app starts a session",
+			steps: []step{{startSession(phone), proto.GatewayOperation_OK}},
+		},
+		{
+			name:  "app that isn't registered",
+			steps: []step{{startSession(tablet), proto.GatewayOperation_NOT_ALLOWED}},
+		},
+		{
+			name: "register and start a session",
+			steps: []step{
+				{register(tablet, tablet, pin), proto.GatewayOperation_OK},
+				{startSession(tablet), proto.GatewayOperation_OK},
+			},
+		},
+		{
+			name: "register with the wrong PIN",
+			steps: []step{
+				{register(tablet, tablet, 1234), proto.GatewayOperation_NOT_ALLOWED},
+				{startSession(tablet), proto.GatewayOperation_NOT_ALLOWED},
+			},
+		},
+		{
+			name:  "register another UUID than Src",
+			steps: []step{{register(tablet, phone, pin), proto.GatewayOperation_NOT_ALLOWED}},
+		},
+		{
+			name: "session for another UUID than the one that registered",
+			steps: []step{
+				{register(tablet, tablet, pin), proto.GatewayOperation_OK},
+				{startSession(phone), proto.GatewayOperation_NOT_ALLOWED},
+			},
+		},
+		{
+			name:  "list registered apps without session",
+			steps: []step{{list(tablet), proto.GatewayOperation_NOT_ALLOWED}},
+		},
+		{
+			name: "list registered apps with session",
+			steps: []step{
+				{startSession(phone), proto.GatewayOperation_OK},
+				{list(phone), proto.GatewayOperation_OK},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registrations, _ := NewRegistrations("", pin)
+			if err := registrations.Register(phone, "phone", pin); err != nil {
+				t.Fatalf("registering: %v", err)
+			}
+			app := handshakeApp(t, registrations)
+
+			for i, s := range tt.steps {
+				response, forwarded := handle(t, app, s.message)
+				if forwarded {
+					t.Fatalf("step %d: %s was forwarded to the gateway", i, s.message.Operation.Type.String())
+				}
+				if response == nil {
+					t.Fatalf("step %d: no response to %s", i, s.message.Operation.Type.String())
+				}
+				// a ListRegisteredAppsConfirm with the apps has no result, which reads as OK
+				if result := response.Operation.GetResult(); result != s.wantResult {
+					t.Errorf("step %d: got %s with %s, want %s", i, response.Operation.Type.String(), result, s.wantResult)
+				}
+				if s.message.Operation.Type.String() == "ListRegisteredAppsRequestType" && s.wantResult == proto.GatewayOperation_OK {
+					if apps := response.OperationType.(*proto.ListRegisteredAppsConfirm).GetApps(); len(apps) != 1 {
+						t.Errorf("step %d: got %d registered apps, want 1", i, len(apps))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestHandleMessageUnknownType(t *testing.T) {
+	tests := []struct {
+		name           string
+		sessionStarted bool
+		online         bool
+		wantForwarded  bool
+	}{
+		{name: "without session", sessionStarted: false, online: true},
+		{name: "with session", sessionStarted: true, online: true, wantForwarded: true},
+		{name: "with session, gateway unreachable", sessionStarted: true, online: false, wantForwarded: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := receive(t, unknownFrame(7))
+			if message.OperationType != nil {
+				t.Fatalf("frame decoded as %T, want an unknown type", message.OperationType)
+			}
+
+			app := testApp(t)
+			app.router = newRouter()
+			app.outbox = newOutbox(10, OverflowDropOldest)
+			app.sessionStarted = tt.sessionStarted
+			gateway := make(chan appMessage, 1)
+
+			app.handleMessage(message, gateway)
+
+			var forwarded *appMessage
+			select {
+			case m := <-gateway:
+				forwarded = &m
+			default:
+			}
+			if (forwarded != nil) != tt.wantForwarded {
+				t.Fatalf("forwarded is %v, want %v", forwarded != nil, tt.wantForwarded)
+			}
+
+			if forwarded != nil && !tt.online {
+				p := Proxy{
+					listener: &Listener{router: app.router},
+					confirms: make(map[string]comfoconnect.Message),
+				}
+				p.answerOffline(forwarded.message)
+			}
+
+			// there is no response for a type the proxy doesn't know, so nothing is sent to the app
+			if n := app.outbox.len(); n != 0 {
+				t.Errorf("%d messages queued for the app, want none", n)
+			}
+		})
+	}
+}
+
+func TestListenerRemovesApps(t *testing.T) {
+	tests := []struct {
+		name       string
+		disconnect bool // the app disconnects, instead of the listener shutting down
+	}{
+		{name: "app disconnects", disconnect: true},
+		{name: "shutting down"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatalf("listening: %v", err)
+			}
+			l := &Listener{
+				listener:      listener,
+				apps:          newAppRegistry(),
+				router:        newRouter(),
+				subscriptions: make(chan appMessage, 1),
+				left:          make(chan *App), // nobody reads it while shutting down
+				QueueSize:     DefaultQueueSize,
+				Registrations: &Registrations{apps: make(map[string]RegisteredApp)},
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			wg := &sync.WaitGroup{}
+			wg.Add(1)
+			go l.Run(ctx, wg)
+
+			conn, err := net.Dial("tcp4", listener.Addr().String())
+			if err != nil {
+				t.Fatalf("connecting: %v", err)
+			}
+			defer conn.Close()
+			var app *App
+			for deadline := time.Now().Add(5 * time.Second); app == nil; {
+				if apps := l.Apps(); len(apps) == 1 {
+					app = apps[0]
+				} else if time.Now().After(deadline) {
+					t.Fatal("the app wasn't added")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if tt.disconnect {
+				_ = conn.Close()
+				select {
+				case left := <-l.left:
+					if left != app {
+						t.Errorf("another app left")
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("the app didn't leave")
+				}
+			}
+			cancel()
+			stopped := make(chan bool)
+			go func() {
+				wg.Wait()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the listener didn't stop")
+			}
+
+			if apps := l.Apps(); len(apps) != 0 {
+				t.Errorf("%d apps are still listed", len(apps))
+			}
+			if state := app.State(); state != AppClosed {
+				t.Errorf("app is %s, want closed", state)
+			}
+		})
+	}
+}
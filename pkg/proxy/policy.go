@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
+	"github.com/hsmade/comfoconnectbridge/proto"
+)
+
+// the first byte of an RMI message is the command, these only read
+var rmiReadCommands = map[byte]bool{
+	0x01: true, // get a property
+	0x02: true, // get multiple properties
+	0x87: true, // get a schedule
+}
+
+// the operation types a read-only app can send, besides RMI requests that read
+var readOnlyOperationTypes = map[string]bool{
+	"CnRpdoRequestType":             true,
+	"CnNodeRequestType":             true,
+	"CnTimeRequestType":             true,
+	"VersionRequestType":            true,
+	"KeepAliveType":                 true,
+	"ListRegisteredAppsRequestType": true,
+	"GetRemoteAccessIdRequestType":  true,
+	"GetSupportIdRequestType":       true,
+	"GetWebIdRequestType":           true,
+	"CnRmiRequestType":              true,
+	"CnRmiAsyncRequestType":         true,
+}
+
+// RmiTarget matches RMI requests, fields that aren't set match anything
+type RmiTarget struct {
+	Node    *uint32 `json:"node" yaml:"node"`
+	Command *uint8  `json:"command" yaml:"command"` // the first byte of the message, like 0x03 to set a property
+	Unit    *uint8  `json:"unit" yaml:"unit"`       // the second byte of the message
+}
+
+func (t RmiTarget) matches(node uint32, message []byte) bool {
+	if t.Node != nil && *t.Node != node {
+		return false
+	}
+	if t.Command != nil && (len(message) < 1 || message[0] != *t.Command) {
+		return false
+	}
+	if t.Unit != nil && (len(message) < 2 || message[1] != *t.Unit) {
+		return false
+	}
+	return true
+}
+
+// Policy is what an app is allowed to send to the gateway
+type Policy struct {
+	UUID       string      `json:"uuid" yaml:"uuid"`               // hex, matched before the device name
+	DeviceName string      `json:"device_name" yaml:"device_name"` // as the app registered
+	ReadOnly   bool        `json:"read_only" yaml:"read_only"`     // only requests that don't change anything
+	Allow      []string    `json:"allow" yaml:"allow"`             // operation types, like CnRmiRequestType. Empty allows all.
+	Deny       []string    `json:"deny" yaml:"deny"`               // operation types
+	DenyRmi    []RmiTarget `json:"deny_rmi" yaml:"deny_rmi"`
+}
+
+// Check returns an error when the policy doesn't allow the message
+func (p Policy) Check(message comfoconnect.Message) error {
+	operationType := message.Operation.Type.String()
+	for _, denied := range p.Deny {
+		if denied == operationType {
+			return errors.New(fmt.Sprintf("%s is denied", operationType))
+		}
+	}
+	if len(p.Allow) > 0 {
+		allowed := false
+		for _, a := range p.Allow {
+			allowed = allowed || a == operationType
+		}
+		if !allowed {
+			return errors.New(fmt.Sprintf("%s isn't allowed", operationType))
+		}
+	}
+	if p.ReadOnly && !readOnlyOperationTypes[operationType] {
+		return errors.New(fmt.Sprintf("%s isn't allowed for a read-only app", operationType))
+	}
+
+	var node uint32
+	var rmi []byte
+	switch request := message.OperationType.(type) {
+	case *proto.CnRmiRequest:
+		node, rmi = request.GetNodeId(), request.GetMessage()
+	case *proto.CnRmiAsyncRequest:
+		node, rmi = request.GetNodeId(), request.GetMessage()
+	default:
+		return nil
+	}
+	if p.ReadOnly && (len(rmi) == 0 || !rmiReadCommands[rmi[0]]) {
+		return errors.New(fmt.Sprintf("RMI %x to node %d isn't allowed for a read-only app", rmi, node))
+	}
+	for _, target := range p.DenyRmi {
+		if target.matches(node, rmi) {
+			return errors.New(fmt.Sprintf("RMI %x to node %d is denied", rmi, node))
+		}
+	}
+	return nil
+}
+
+// PolicyConfig is the file with the policies
+type PolicyConfig struct {
+	Default *Policy  `json:"default" yaml:"default"` // for apps without a policy, allows all when not set
+	Apps    []Policy `json:"apps" yaml:"apps"`
+}
+
+// Policies decides what each app may send to the gateway. It can be reloaded while apps are connected.
+type Policies struct {
+	lock   sync.RWMutex
+	path   string
+	config PolicyConfig
+}
+
+// NewPolicies loads the policies from a YAML or JSON file (by extension). An empty path allows everything.
+func NewPolicies(path string) (*Policies, error) {
+	p := &Policies{path: path}
+	return p, p.Reload()
+}
+
+// Reload reads the file again, the old policies stay when it is invalid
+func (p *Policies) Reload() error {
+	if p.path == "" {
+		return nil
+	}
+	log := logrus.WithFields(logrus.Fields{
+		"module": "proxy",
+		"object": "Policies",
+		"method": "Reload",
+		"path":   p.path,
+	})
+
+	b, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		log.Errorf("failed to read policies: %v", err)
+		return errors.Wrap(err, fmt.Sprintf("reading policies %s", p.path))
+	}
+
+	var config PolicyConfig
+	switch strings.ToLower(filepath.Ext(p.path)) {
+	case ".json":
+		err = json.Unmarshal(b, &config)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(b, &config)
+	default:
+		err = errors.New("unknown extension, expected .json, .yaml or .yml")
+	}
+	if err != nil {
+		log.Errorf("failed to parse policies: %v", err)
+		return errors.Wrap(err, fmt.Sprintf("parsing policies %s", p.path))
+	}
+	for _, policy := range config.Apps {
+		if policy.UUID == "" && policy.DeviceName == "" {
+			return errors.New(fmt.Sprintf("policies %s contain a policy without uuid or device_name: %+v", p.path, policy))
+		}
+		if _, err := hex.DecodeString(policy.UUID); err != nil {
+			return errors.New(fmt.Sprintf("policies %s contain an invalid uuid: %s", p.path, policy.UUID))
+		}
+	}
+
+	p.lock.Lock()
+	p.config = config
+	p.lock.Unlock()
+	log.Infof("loaded %d policies", len(config.Apps))
+	return nil
+}
+
+// For returns the policy of an app, by UUID or else by device name, or the default policy
+func (p *Policies) For(uuid []byte, deviceName string) Policy {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	id := hex.EncodeToString(uuid)
+	for _, policy := range p.config.Apps {
+		if policy.UUID != "" && strings.EqualFold(policy.UUID, id) {
+			return policy
+		}
+	}
+	for _, policy := range p.config.Apps {
+		if policy.UUID == "" && policy.DeviceName != "" && policy.DeviceName == deviceName {
+			return policy
+		}
+	}
+	if p.config.Default != nil {
+		return *p.config.Default
+	}
+	return Policy{}
+}
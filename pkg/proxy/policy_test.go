@@ -0,0 +1,359 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
+	"github.com/hsmade/comfoconnectbridge/proto"
+)
+
+func uint8Pointer(v uint8) *uint8 {
+	return &v
+}
+
+func uint32Pointer(v uint32) *uint32 {
+	return &v
+}
+
+// returns a request of `operationType`, an RMI request when `rmi` is set
+func policyMessage(operationType proto.GatewayOperation_OperationType, node uint32, rmi []byte) comfoconnect.Message {
+	message := comfoconnect.Message{Operation: proto.GatewayOperation{Type: operationType.Enum()}}
+	switch operationType {
+	case proto.GatewayOperation_CnRmiRequestType:
+		message.OperationType = &proto.CnRmiRequest{NodeId: &node, Message: rmi}
+	case proto.GatewayOperation_CnRmiAsyncRequestType:
+		message.OperationType = &proto.CnRmiAsyncRequest{NodeId: &node, Message: rmi}
+	}
+	return message
+}
+
+func TestPolicyCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		message comfoconnect.Message
+		wantErr bool
+	}{
+		{
+			name:    "empty policy allows all",
+			message: policyMessage(proto.GatewayOperation_CnRmiRequestType, 1, []byte{0x03, 0x1d, 0x01}),
+		},
+		{
+			name:    "denied type",
+			policy:  Policy{Deny: []string{"DeregisterAppRequestType"}},
+			message: policyMessage(proto.GatewayOperation_DeregisterAppRequestType, 0, nil),
+			wantErr: true,
+		},
+		{
+			name:    "other type than the denied one",
+			policy:  Policy{Deny: []string{"DeregisterAppRequestType"}},
+			message: policyMessage(proto.GatewayOperation_CnTimeRequestType, 0, nil),
+		},
+		{
+			name:    "allowed type",
+			policy:  Policy{Allow: []string{"CnTimeRequestType", "CnRpdoRequestType"}},
+			message: policyMessage(proto.GatewayOperation_CnRpdoRequestType, 0, nil),
+		},
+		{
+			name:    "type that isn't allowed",
+			policy:  Policy{Allow: []string{"CnTimeRequestType"}},
+			message: policyMessage(proto.GatewayOperation_CnRpdoRequestType, 0, nil),
+			wantErr: true,
+		},
+		{
+			name:    "deny wins from allow",
+			policy:  Policy{Allow: []string{"CnTimeRequestType"}, Deny: []string{"CnTimeRequestType"}},
+			message: policyMessage(proto.GatewayOperation_CnTimeRequestType, 0, nil),
+			wantErr: true,
+		},
+		{
+			name:    "read-only, read type",
+			policy:  Policy{ReadOnly: true},
+			message: policyMessage(proto.GatewayOperation_VersionRequestType, 0, nil),
+		},
+		{
+			name:    "read-only, changing type",
+			policy:  Policy{ReadOnly: true},
+			message: policyMessage(proto.GatewayOperation_DeregisterAppRequestType, 0, nil),
+			wantErr: true,
+		},
+		{
+			name:    "read-only, RMI that reads",
+			policy:  Policy{ReadOnly: true},
+			message: policyMessage(proto.GatewayOperation_CnRmiRequestType, 1, []byte{0x01, 0x1d, 0x01, 0x10, 0x0a}),
+		},
+		{
+			name:    "read-only, RMI that writes",
+			policy:  Policy{ReadOnly: true},
+			message: policyMessage(proto.GatewayOperation_CnRmiRequestType, 1, []byte{0x03, 0x1d, 0x01, 0x10, 0x0a}),
+			wantErr: true,
+		},
+		{
+			name:    "read-only, async RMI that writes",
+			policy:  Policy{ReadOnly: true},
+			message: policyMessage(proto.GatewayOperation_CnRmiAsyncRequestType, 1, []byte{0x84, 0x15, 0x01}),
+			wantErr: true,
+		},
+		{
+			name:    "read-only, empty RMI",
+			policy:  Policy{ReadOnly: true},
+			message: policyMessage(proto.GatewayOperation_CnRmiRequestType, 1, nil),
+			wantErr: true,
+		},
+		{
+			name:    "denied RMI command",
+			policy:  Policy{DenyRmi: []RmiTarget{{Command: uint8Pointer(0x03)}}},
+			message: policyMessage(proto.GatewayOperation_CnRmiRequestType, 1, []byte{0x03, 0x1d, 0x01}),
+			wantErr: true,
+		},
+		{
+			name:    "denied RMI command on another node",
+			policy:  Policy{DenyRmi: []RmiTarget{{Node: uint32Pointer(2), Command: uint8Pointer(0x03)}}},
+			message: policyMessage(proto.GatewayOperation_CnRmiRequestType, 1, []byte{0x03, 0x1d, 0x01}),
+		},
+		{
+			name:    "denied RMI unit",
+			policy:  Policy{DenyRmi: []RmiTarget{{Node: uint32Pointer(1), Unit: uint8Pointer(0x1d)}}},
+			message: policyMessage(proto.GatewayOperation_CnRmiAsyncRequestType, 1, []byte{0x01, 0x1d, 0x01}),
+			wantErr: true,
+		},
+		{
+			name:    "RMI too short for the denied unit",
+			policy:  Policy{DenyRmi: []RmiTarget{{Unit: uint8Pointer(0x1d)}}},
+			message: policyMessage(proto.GatewayOperation_CnRmiRequestType, 1, []byte{0x01}),
+		},
+		{
+			name:    "denied RMI doesn't apply to other types",
+			policy:  Policy{DenyRmi: []RmiTarget{{}}},
+			message: policyMessage(proto.GatewayOperation_CnTimeRequestType, 0, nil),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Check(tt.message)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// writePolicies writes `content` to a file with `name` in a new directory, remove the directory when done
+func writePolicies(t *testing.T, name string, content string) (string, string) {
+	dir, err := ioutil.TempDir("", "policies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	err = ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir, path
+}
+
+func TestPoliciesFor(t *testing.T) {
+	dir, path := writePolicies(t, "policies.yaml", `
+default:
+  read_only: true
+apps:
+  - device_name: phone
+    deny: [CnRmiRequestType]
+  - uuid: 0202020202020202020202020202020A
+    allow: [CnTimeRequestType]
+  - device_name: tablet
+    deny: [VersionRequestType]
+`)
+	defer os.RemoveAll(dir)
+
+	policies, err := NewPolicies(path)
+	if err != nil {
+		t.Fatalf("loading policies: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		uuid       []byte
+		deviceName string
+		want       Policy
+	}{
+		{
+			name:       "by device name",
+			uuid:       bytes.Repeat([]byte{0x01}, 16),
+			deviceName: "phone",
+			want:       Policy{DeviceName: "phone", Deny: []string{"CnRmiRequestType"}},
+		},
+		{
+			name:       "by uuid before device name",
+			uuid:       append(bytes.Repeat([]byte{0x02}, 15), 0x0a),
+			deviceName: "tablet",
+			want:       Policy{UUID: "0202020202020202020202020202020A", Allow: []string{"CnTimeRequestType"}},
+		},
+		{
+			name:       "default",
+			uuid:       bytes.Repeat([]byte{0x03}, 16),
+			deviceName: "laptop",
+			want:       Policy{ReadOnly: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := policies.For(tt.uuid, tt.deviceName)
+			if got.UUID != tt.want.UUID || got.DeviceName != tt.want.DeviceName || got.ReadOnly != tt.want.ReadOnly ||
+				len(got.Allow) != len(tt.want.Allow) || len(got.Deny) != len(tt.want.Deny) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoliciesReload(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		wantErr bool
+	}{
+		{name: "yaml", file: "p.yml", content: "apps:\n  - device_name: phone\n    read_only: true\n"},
+		{name: "json", file: "p.json", content: `{"apps": [{"device_name": "phone", "read_only": true}]}`},
+		{name: "unknown extension", file: "p.txt", content: "apps: []\n", wantErr: true},
+		{name: "unknown field", file: "p.yaml", content: "apps:\n  - device_name: phone\n    readonly: true\n", wantErr: true},
+		{name: "policy without app", file: "p.yaml", content: "apps:\n  - read_only: true\n", wantErr: true},
+		{name: "invalid uuid", file: "p.yaml", content: "apps:\n  - uuid: phone\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, path := writePolicies(t, tt.file, tt.content)
+			defer os.RemoveAll(dir)
+
+			policies, err := NewPolicies(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want an error: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !policies.For(nil, "phone").ReadOnly {
+				t.Error("the policy of the phone isn't read-only")
+			}
+		})
+	}
+}
+
+func TestDeregisterAppPolicy(t *testing.T) {
+	const pin = 4321
+	phone := bytes.Repeat([]byte{0x01}, 16)
+
+	tests := []struct {
+		name       string
+		policies   string
+		wantResult proto.GatewayOperation_GatewayResult
+	}{
+		{name: "allowed", policies: "apps: []\n", wantResult: proto.GatewayOperation_OK},
+		{name: "read-only", policies: "default:\n  read_only: true\n", wantResult: proto.GatewayOperation_NOT_ALLOWED},
+		{name: "denied", policies: "apps:\n  - device_name: phone\n    deny: [DeregisterAppRequestType]\n", wantResult: proto.GatewayOperation_NOT_ALLOWED},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, path := writePolicies(t, "policies.yaml", tt.policies)
+			defer os.RemoveAll(dir)
+			policies, err := NewPolicies(path)
+			if err != nil {
+				t.Fatalf("loading policies: %v", err)
+			}
+			registrations, _ := NewRegistrations("", pin)
+			if err := registrations.Register(phone, "phone", pin); err != nil {
+				t.Fatalf("registering: %v", err)
+			}
+
+			app := testApp(t)
+			app.outbox = newOutbox(10, OverflowDropOldest)
+			app.registrations = registrations
+			app.policies = policies
+			app.sessionStarted = true
+			app.setUUID(phone)
+
+			operationType := proto.GatewayOperation_DeregisterAppRequestType
+			request := comfoconnect.Message{
+				Src:           phone,
+				Dst:           bytes.Repeat([]byte{0x02}, 16),
+				Operation:     proto.GatewayOperation{Type: &operationType, Reference: uint32Pointer(5)},
+				OperationType: &proto.DeregisterAppRequest{Uuid: phone},
+			}
+			app.handleMessage(receive(t, request.Encode()), make(chan appMessage))
+
+			item, ok := app.outbox.pop()
+			if !ok {
+				t.Fatal("no response")
+			}
+			response := receive(t, item.data)
+			if response.Operation.Type.String() != "DeregisterAppConfirmType" || response.Operation.GetResult() != tt.wantResult {
+				t.Errorf("got %s with %s, want DeregisterAppConfirmType with %s", response.Operation.Type.String(), response.Operation.GetResult(), tt.wantResult)
+			}
+			if registered := registrations.Registered(phone); registered != (tt.wantResult != proto.GatewayOperation_OK) {
+				t.Errorf("app is registered: %v, after %s", registered, response.Operation.GetResult())
+			}
+		})
+	}
+}
+
+func TestPolicyOfSessionUUID(t *testing.T) {
+	const pin = 4321
+	phone := bytes.Repeat([]byte{0x01}, 16)
+	tablet := bytes.Repeat([]byte{0x03}, 16)
+
+	dir, path := writePolicies(t, "policies.yaml", "apps:\n  - device_name: tablet\n    read_only: true\n")
+	defer os.RemoveAll(dir)
+	policies, err := NewPolicies(path)
+	if err != nil {
+		t.Fatalf("loading policies: %v", err)
+	}
+
+	rmi := func(src []byte, command byte) comfoconnect.Message {
+		return appRequest(t, src, proto.GatewayOperation_CnRmiRequestType, &proto.CnRmiRequest{NodeId: uint32Pointer(1), Message: []byte{command, 0x1d, 0x01, 0x10, 0x0a}})
+	}
+
+	tests := []struct {
+		name          string
+		message       comfoconnect.Message
+		wantForwarded bool
+	}{
+		{name: "read with its own Src", message: rmi(tablet, 0x01), wantForwarded: true},
+		{name: "write with its own Src", message: rmi(tablet, 0x03)},
+		{name: "write with the Src of an app that may write", message: rmi(phone, 0x03)},
+		{name: "read with the Src of another app", message: rmi(phone, 0x01)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registrations, _ := NewRegistrations("", pin)
+			for uuid, deviceName := range map[string]string{string(phone): "phone", string(tablet): "tablet"} {
+				if err := registrations.Register([]byte(uuid), deviceName, pin); err != nil {
+					t.Fatalf("registering: %v", err)
+				}
+			}
+			app := handshakeApp(t, registrations)
+			app.policies = policies
+			if response, _ := handle(t, app, appRequest(t, tablet, proto.GatewayOperation_StartSessionRequestType, &proto.StartSessionRequest{})); response == nil || response.Operation.GetResult() != proto.GatewayOperation_OK {
+				t.Fatalf("starting session: %v", response)
+			}
+
+			response, forwarded := handle(t, app, tt.message)
+			if forwarded != tt.wantForwarded {
+				t.Fatalf("forwarded is %v, want %v", forwarded, tt.wantForwarded)
+			}
+			if !forwarded && (response == nil || response.Operation.GetResult() != proto.GatewayOperation_NOT_ALLOWED) {
+				t.Errorf("got %v, want NOT_ALLOWED", response)
+			}
+		})
+	}
+}
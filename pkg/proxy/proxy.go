@@ -10,16 +10,32 @@ import (
 	"github.com/uber/jaeger-client-go"
 
 	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
+	"github.com/hsmade/comfoconnectbridge/proto"
 )
 
+// the consumer name of the subscriptions the proxy makes for itself
+const proxyConsumer = "proxy"
+
 type Proxy struct {
 	client      *Client
 	uuid        []byte
 	listener    *Listener
-	toGateway   chan comfoconnect.Message
+	toGateway   chan appMessage
 	fromGateway chan comfoconnect.Message
 	quit        chan bool
 	exited      chan bool
+
+	// see Use, the metrics interceptor is always first
+	interceptors []Interceptor
+
+	// the last CnRpdoNotification per ppid, replayed to apps that subscribe after the gateway sent it
+	notifications map[uint32]comfoconnect.Message
+
+	// the last confirm of the gateway per request type, replayed while it's unreachable, see offlineReplays
+	confirms map[string]comfoconnect.Message
+
+	// State holds the latest values that passed through the proxy, export it with instrumentation.NewPdoCollector
+	State *comfoconnect.StateStore
 }
 
 var (
@@ -37,13 +53,6 @@ var (
 		},
 		[]string{"message_type"},
 	)
-	metricsGauge = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "comfoconnect_pdo_value",
-			Help: "Value for the different PDOs, as they're seen by the proxy",
-		},
-		[]string{"ID", "description"},
-	)
 )
 
 func NewProxy(gatewayIP string, myMacAddress []byte) *Proxy {
@@ -57,9 +66,9 @@ func NewProxy(gatewayIP string, myMacAddress []byte) *Proxy {
 
 	prometheus.MustRegister(proxyMessagefromGateway)
 	prometheus.MustRegister(proxyMessagetoGateway)
-	prometheus.MustRegister(metricsGauge)
+	prometheus.MustRegister(interceptedCount)
 
-	listenerToGateway := make(chan comfoconnect.Message, 500)
+	listenerToGateway := make(chan appMessage, 500)
 	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
 		Name: "comfoconnect_proxy_listener_toGateway_queue_length",
 		Help: "The current number of items on listenerToGateway queue.",
@@ -94,11 +103,58 @@ func NewProxy(gatewayIP string, myMacAddress []byte) *Proxy {
 		uuid:        uuid,
 		toGateway:   listenerToGateway,
 		fromGateway: clientFromGateway,
+		State:       comfoconnect.NewStateStore(),
+
+		notifications: make(map[uint32]comfoconnect.Message),
+		confirms:      make(map[string]comfoconnect.Message),
 	}
+	p.Use(metricsInterceptor{state: p.State})
 
 	return &p
 }
 
+// SetAppQueue sets the size of the outbound queue of each app, and what to do when it's full. Call before Run.
+func (p *Proxy) SetAppQueue(size int, overflow OverflowPolicy) {
+	p.listener.QueueSize = size
+	p.listener.Overflow = overflow
+}
+
+// SetRegistrations sets the apps that may start a session, and the PIN they need to register. Call before Run.
+func (p *Proxy) SetRegistrations(registrations *Registrations) {
+	p.listener.Registrations = registrations
+}
+
+// SetPolicies sets what each app may send to the gateway. Call before Run, reload the policies to change them.
+func (p *Proxy) SetPolicies(policies *Policies) {
+	p.listener.Policies = policies
+}
+
+// Apps returns the registry of the connected apps, serve it over HTTP to list and kick them
+func (p *Proxy) Apps() *AppRegistry {
+	return p.listener.Registry()
+}
+
+// SetAuditLog logs the state-changing requests of the apps to `audit`, after the interceptors that were added before.
+// Call before Run.
+func (p *Proxy) SetAuditLog(audit *AuditLog) {
+	p.listener.Audit = audit
+	p.Use(audit)
+}
+
+// SetTransparent makes the proxy forward the bytes of messages as they were received, and only change the Src, Dst
+// and the reference. That keeps fields and operation types that aren't in zehnder.proto. Messages that an interceptor
+// changed are encoded again. Call before Run.
+func (p *Proxy) SetTransparent(transparent bool) {
+	p.listener.Transparent = transparent
+	p.client.Transparent = transparent
+}
+
+// Subscribe requests PDOs for the proxy itself, to have them in State and the metrics.
+// These subscriptions are shared with the ones of the apps, but the apps only get the PDOs they subscribed to.
+func (p *Proxy) Subscribe(subscriptions ...comfoconnect.Subscription) error {
+	return p.client.Subscribe(proxyConsumer, subscriptions...)
+}
+
 func (p Proxy) Run(ctx context.Context, wg *sync.WaitGroup) {
 	log := logrus.WithFields(logrus.Fields{
 		"module": "proxy",
@@ -127,20 +183,41 @@ func (p Proxy) Run(ctx context.Context, wg *sync.WaitGroup) {
 			wg.Wait()
 			return
 
-		case message := <-p.toGateway:
+		case request := <-p.toGateway:
+			message := request.message
 			proxyMessagetoGateway.WithLabelValues(message.Operation.Type.String()).Inc()
 			log.Debugf("received a message for the gateway: %v", message)
 			span := opentracing.GlobalTracer().StartSpan("proxy.Proxy.Run.ReceivedForGateway", opentracing.ChildOf(message.Span.Context()))
 			comfoconnect.SpanSetMessage(span, message)
 			message.Span = span
 
-			generateMetrics(message)
+			if !p.interceptAppToGateway(request.app, &message) {
+				span.Finish()
+				break
+			}
 
-			log.WithField("span", span.Context().(jaeger.SpanContext).String()).Debugf("forwarding message to gateway: %v", message)
-			p.client.toGateway <- message
+			if p.client.Connected() {
+				log.WithField("span", span.Context().(jaeger.SpanContext).String()).Debugf("forwarding message to gateway: %v", message)
+				p.client.toGateway <- message
+			} else {
+				p.answerOffline(message)
+			}
 
 			span.Finish()
 
+		case connected := <-p.client.StateChanges:
+			p.publishState(connected)
+
+		case request := <-p.listener.subscriptions:
+			p.handleSubscription(request)
+
+		case app := <-p.listener.left:
+			log.Debugf("dropping subscriptions of %s", app.ID())
+			err := p.client.UnsubscribeAll(app.ID())
+			if err != nil {
+				log.Errorf("failed to drop subscriptions of %s: %v", app.ID(), err)
+			}
+
 		case message := <-p.fromGateway:
 			proxyMessagefromGateway.WithLabelValues(message.Operation.Type.String()).Inc()
 			span := opentracing.GlobalTracer().StartSpan("proxy.Proxy.Run.ReceivedFromGateway", opentracing.ChildOf(message.Span.Context()))
@@ -148,16 +225,43 @@ func (p Proxy) Run(ctx context.Context, wg *sync.WaitGroup) {
 			message.Span = span
 
 			log.WithField("span", span.Context().(jaeger.SpanContext).String()).Debugf("received a message from gateway: %v", message)
-			generateMetrics(message)
+			if !p.interceptGatewayToApp(&message) {
+				span.Finish()
+				break
+			}
+
+			if message.Operation.Type.String() == "CnRpdoNotificationType" {
+				p.notifications[message.OperationType.(*proto.CnRpdoNotification).GetPdid()] = message
+			}
+			if requestType, ok := offlineReplays[message.Operation.Type.String()]; ok && message.Operation.GetResult() == proto.GatewayOperation_OK {
+				p.confirms[requestType] = message
+			}
+
+			// responses go back to the app that sent the request, notifications go to all apps
+			var apps []*App
+			if app, ok := p.listener.router.resolve(&message); ok {
+				apps = []*App{app}
+			} else if message.Operation.Type.String() == "CnRpdoNotificationType" {
+				ppid := message.OperationType.(*proto.CnRpdoNotification).GetPdid()
+				for _, app := range p.listener.Apps() {
+					if p.client.Subscribed(app.ID(), ppid) {
+						apps = append(apps, app)
+					}
+				}
+			} else if isNotification(message) {
+				apps = p.listener.SessionApps()
+			} else {
+				log.WithField("span", span.Context().(jaeger.SpanContext).String()).Debugf("dropping %s with reference %d, no app is waiting for it", message.Operation.Type.String(), message.Operation.GetReference())
+			}
 
-			log.WithField("span", span.Context().(jaeger.SpanContext).String()).Debugf("going to copy to %d apps", len(p.listener.apps))
-			for _, app := range p.listener.apps {
+			log.WithField("span", span.Context().(jaeger.SpanContext).String()).Debugf("going to copy to %d apps", len(apps))
+			for _, app := range apps {
 				message.Src = p.uuid // masquerade
-				message.Dst = app.uuid // masquerade
-				log.Debugf("copying message from gateway to app(%s/%x):%v", app.conn.RemoteAddr().String(), app.uuid, message)
+				message.Dst = app.UUID() // masquerade
+				log.Debugf("copying message from gateway to app(%s):%v", app.ID(), message)
 				err := app.Write(message)
 				if err != nil {
-					log.Errorf("error while copying message from gateway to app(%s/%x):%v", app.conn.RemoteAddr().String(), app.uuid, err)
+					log.Errorf("error while copying message from gateway to app(%s):%v", app.ID(), err)
 				}
 			}
 
@@ -166,23 +270,183 @@ func (p Proxy) Run(ctx context.Context, wg *sync.WaitGroup) {
 	}
 }
 
-func generateMetrics(message comfoconnect.Message) {
-	span := opentracing.GlobalTracer().StartSpan("proxy.generateMetrics", opentracing.ChildOf(message.Span.Context()))
+// handleSubscription merges the CnRpdoRequest of an app with the subscriptions of the other apps, and confirms it
+// to the app without waiting for the gateway. Retries of requests that the gateway didn't confirm are done by the session.
+func (p Proxy) handleSubscription(request appMessage) {
+	message := request.message
+	span := opentracing.GlobalTracer().StartSpan("proxy.Proxy.handleSubscription", opentracing.ChildOf(message.Span.Context()))
+	comfoconnect.SpanSetMessage(span, message)
+	defer span.Finish()
+
+	log := logrus.WithFields(logrus.Fields{
+		"module": "proxy",
+		"object": "Proxy",
+		"method": "handleSubscription",
+		"app":    request.app.ID(),
+		"span":   span.Context().(jaeger.SpanContext).String(),
+	})
+
+	if !p.interceptAppToGateway(request.app, &message) {
+		return
+	}
+
+	rpdo := message.OperationType.(*proto.CnRpdoRequest)
+	var err error
+	if rpdo.Timeout != nil && rpdo.GetTimeout() == 0 {
+		log.Debugf("unsubscribing from ppid %d", rpdo.GetPdid())
+		err = p.client.Unsubscribe(request.app.ID(), rpdo.GetPdid())
+	} else {
+		log.Debugf("subscribing to ppid %d", rpdo.GetPdid())
+		err = p.client.Subscribe(request.app.ID(), comfoconnect.Subscription{
+			Ppid:    rpdo.GetPdid(),
+			Type:    comfoconnect.PdoType(rpdo.GetType()),
+			Timeout: rpdo.GetTimeout(),
+		})
+	}
+	if err != nil {
+		span.SetTag("err", err)
+		log.Warnf("failed to update subscription: %v", err)
+	}
+
+	err = request.app.send(message.CreateResponse(span, proto.GatewayOperation_OK), "CnRpdoConfirmType")
+	if err != nil {
+		span.SetTag("err", err)
+		log.Warnf("failed to write CnRpdoConfirm: %v", err)
+		return
+	}
+
+	if rpdo.Timeout == nil || rpdo.GetTimeout() != 0 {
+		p.replayNotification(request.app, rpdo.GetPdid(), span)
+	}
+}
+
+// the requests that are answered by the proxy while the gateway is unreachable, all others get NOT_REACHABLE
+var offlineAnswers = map[string]bool{
+	"CnTimeRequestType":       true,
+	"CloseSessionRequestType": true,
+}
+
+// the confirms of the gateway that are kept, by the request they answer. While the gateway is unreachable, these requests
+// get the last confirm the gateway sent, or NOT_REACHABLE when it never sent one.
+var offlineReplays = map[string]string{
+	"VersionConfirmType":           "VersionRequestType",
+	"GetRemoteAccessIdConfirmType": "GetRemoteAccessIdRequestType",
+}
+
+// answerOffline responds to a message from an app while the gateway is unreachable, so the app doesn't wait for
+// a response that never comes. Handshakes are answered with what the gateway answered before, everything else is rejected.
+func (p Proxy) answerOffline(message comfoconnect.Message) {
+	span := opentracing.GlobalTracer().StartSpan("proxy.Proxy.answerOffline", opentracing.ChildOf(message.Span.Context()))
 	comfoconnect.SpanSetMessage(span, message)
 	defer span.Finish()
 
 	log := logrus.WithFields(logrus.Fields{
 		"module": "proxy",
-		"method": "generateMetrics",
+		"object": "Proxy",
+		"method": "answerOffline",
 		"span":   span.Context().(jaeger.SpanContext).String(),
 	})
 
-	switch message.Operation.Type.String() {
-	case "CnRpdoNotificationType":
-		conv := message.DecodePDO()
-		metricsGauge.WithLabelValues(conv.GetID(), conv.GetDescription()).Set(conv.Tofloat64())
-	case "CnAlarmNotificationType":
-		log.Warnf("Got alarm notification: %v", message)
+	forwarded := message // with the reference of the proxy, for the audit log
+	app, ok := p.listener.router.resolve(&message)
+	if !ok {
+		log.Debugf("gateway is unreachable, dropping %s", message.Operation.Type.String())
+		return
+	}
+	if message.Operation.Type.String() == "KeepAliveType" {
+		return
+	}
+
+	status := proto.GatewayOperation_NOT_REACHABLE
+	if offlineAnswers[message.Operation.Type.String()] {
+		status = proto.GatewayOperation_OK
+	}
+	var response []byte
+	if confirm, ok := p.confirms[message.Operation.Type.String()]; ok {
+		reference := message.Operation.GetReference()
+		confirm.Src = message.Dst
+		confirm.Dst = message.Src
+		confirm.Operation.Reference = &reference
+		status = confirm.Operation.GetResult()
+		response = confirm.Encode()
+	} else {
+		response = message.CreateResponse(span, status)
+	}
+	if response == nil {
+		log.Warnf("gateway is unreachable, no response for %s", message.Operation.Type.String())
+		return
+	}
+
+	log.Debugf("gateway is unreachable, answering %s from app(%s) with %s", message.Operation.Type.String(), app.ID(), status.String())
+	p.listener.Audit.Local(app, forwarded, status)
+	err := app.send(response, "OfflineResponse")
+	if err != nil {
+		span.SetTag("err", err)
+		log.Warnf("failed to write response: %v", err)
+	}
+}
+
+// publishState tells the apps whether the gateway is reachable, by announcing the ventilation unit as online or offline
+func (p Proxy) publishState(connected bool) {
+	log := logrus.WithFields(logrus.Fields{
+		"module": "proxy",
+		"object": "Proxy",
+		"method": "publishState",
+	})
+	if connected {
+		log.Info("gateway is reachable, forwarding to the gateway")
+	} else {
+		log.Warn("gateway is unreachable, serving apps from cache")
+	}
+	p.listener.SetOnline(connected)
+
+	operationType := proto.GatewayOperation_CnNodeNotificationType
+	for _, app := range p.listener.SessionApps() {
+		err := app.Write(comfoconnect.Message{
+			Src:           p.uuid, // masquerade
+			Dst:           app.UUID(),
+			Operation:     proto.GatewayOperation{Type: &operationType},
+			OperationType: ventilationNodeNotification(connected),
+			Span:          opentracing.StartSpan("proxy.Proxy.publishState"),
+		})
+		if err != nil {
+			log.Warnf("failed to send state to app(%s): %v", app.ID(), err)
+		}
+	}
+}
+
+// replayNotification sends the last known value of `ppid` to `app`, as the gateway would have sent it.
+// The gateway only sends changes, so without this an app that subscribes late has no value until it changes.
+func (p Proxy) replayNotification(app *App, ppid uint32, parent opentracing.Span) {
+	cached, ok := p.notifications[ppid]
+	if !ok {
+		return
+	}
+
+	span := opentracing.GlobalTracer().StartSpan("proxy.Proxy.replayNotification", opentracing.ChildOf(parent.Context()))
+	defer span.Finish()
+
+	operationType := proto.GatewayOperation_CnRpdoNotificationType
+	message := comfoconnect.Message{
+		Src:           p.uuid, // masquerade
+		Dst:           app.UUID(),
+		Operation:     proto.GatewayOperation{Type: &operationType},
+		OperationType: cached.OperationType,
+		Span:          span,
+	}
+	comfoconnect.SpanSetMessage(span, message)
+
+	log := logrus.WithFields(logrus.Fields{
+		"module": "proxy",
+		"object": "Proxy",
+		"method": "replayNotification",
+		"app":    app.ID(),
+		"span":   span.Context().(jaeger.SpanContext).String(),
+	})
+	log.Debugf("replaying last value of ppid %d", ppid)
+	err := app.Write(message)
+	if err != nil {
+		span.SetTag("err", err)
+		log.Warnf("failed to replay ppid %d: %v", ppid, err)
 	}
-	log.Debugf("called for %v", message)
 }
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"sync"
+)
+
+// OverflowPolicy decides what happens when the outbound queue of an app is full
+type OverflowPolicy string
+
+const (
+	OverflowDropOldest OverflowPolicy = "drop-oldest" // drop the oldest notification, responses are kept
+	OverflowDisconnect OverflowPolicy = "disconnect"  // disconnect the app, it will have to reconnect
+
+	DefaultQueueSize = 500
+)
+
+// pushResult is what happened to an item that was pushed on an outbox
+type pushResult int
+
+const (
+	pushed     pushResult = iota // queued, possibly after dropping older notifications
+	pushFull                     // the queue is full, the app should be disconnected
+	pushClosed                   // the app is already disconnected
+)
+
+// outbound is a message that is waiting to be written to an app
+type outbound struct {
+	data          []byte
+	operationType string
+	notification  bool
+}
+
+// outbox is the bounded queue of messages for an app, so a slow app doesn't block the others
+type outbox struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	items  []outbound
+	size   int
+	policy OverflowPolicy
+	closed bool
+}
+
+func newOutbox(size int, policy OverflowPolicy) *outbox {
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	o := &outbox{
+		size:   size,
+		policy: policy,
+	}
+	o.cond = sync.NewCond(&o.lock)
+	return o
+}
+
+// push adds an item to the queue. When the queue is full, it returns the number of dropped messages,
+// or pushFull when the app should be disconnected instead.
+func (o *outbox) push(item outbound) (int, pushResult) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.closed {
+		return 0, pushClosed
+	}
+
+	dropped := 0
+	if len(o.items) >= o.size {
+		if o.policy == OverflowDisconnect {
+			return 0, pushFull
+		}
+		oldest := -1
+		for i, queued := range o.items {
+			if queued.notification {
+				oldest = i
+				break
+			}
+		}
+		switch {
+		case oldest >= 0:
+			o.items = append(o.items[:oldest], o.items[oldest+1:]...)
+			dropped++
+		case item.notification:
+			return 1, pushed
+		default:
+			// only responses are queued, the app isn't reading at all
+			return 0, pushFull
+		}
+	}
+
+	o.items = append(o.items, item)
+	o.cond.Signal()
+	return dropped, pushed
+}
+
+// pop waits for the next item, returns false when the queue is closed
+func (o *outbox) pop() (outbound, bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for len(o.items) == 0 && !o.closed {
+		o.cond.Wait()
+	}
+	if o.closed {
+		return outbound{}, false
+	}
+	item := o.items[0]
+	o.items = o.items[1:]
+	return item, true
+}
+
+func (o *outbox) len() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.items)
+}
+
+func (o *outbox) close() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.closed = true
+	o.items = nil
+	o.cond.Broadcast()
+}
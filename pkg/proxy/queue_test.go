@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"testing"
+)
+
+func notification(name string) outbound {
+	return outbound{data: []byte(name), operationType: "CnRpdoNotificationType", notification: true}
+}
+
+func response(name string) outbound {
+	return outbound{data: []byte(name), operationType: "CnRmiResponseType"}
+}
+
+func TestOutboxPush(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      OverflowPolicy
+		queued      []outbound
+		closed      bool
+		item        outbound
+		wantDropped int
+		wantResult  pushResult
+		want        []string // the queue afterwards
+	}{
+		{
+			name:       "room left",
+			policy:     OverflowDropOldest,
+			queued:     []outbound{notification("n1")},
+			item:       notification("n2"),
+			wantResult: pushed,
+			want:       []string{"n1", "n2"},
+		},
+		{
+			name:        "full, drops the oldest notification",
+			policy:      OverflowDropOldest,
+			queued:      []outbound{response("r1"), notification("n1"), notification("n2")},
+			item:        notification("n3"),
+			wantDropped: 1,
+			wantResult:  pushed,
+			want:        []string{"r1", "n2", "n3"},
+		},
+		{
+			name:        "full, a response drops a notification",
+			policy:      OverflowDropOldest,
+			queued:      []outbound{notification("n1"), response("r1"), notification("n2")},
+			item:        response("r2"),
+			wantDropped: 1,
+			wantResult:  pushed,
+			want:        []string{"r1", "n2", "r2"},
+		},
+		{
+			name:        "full of responses, drops the new notification",
+			policy:      OverflowDropOldest,
+			queued:      []outbound{response("r1"), response("r2"), response("r3")},
+			item:        notification("n1"),
+			wantDropped: 1,
+			wantResult:  pushed,
+			want:        []string{"r1", "r2", "r3"},
+		},
+		{
+			name:       "full of responses, a response disconnects",
+			policy:     OverflowDropOldest,
+			queued:     []outbound{response("r1"), response("r2"), response("r3")},
+			item:       response("r4"),
+			wantResult: pushFull,
+			want:       []string{"r1", "r2", "r3"},
+		},
+		{
+			name:       "full, disconnect policy",
+			policy:     OverflowDisconnect,
+			queued:     []outbound{notification("n1"), notification("n2"), notification("n3")},
+			item:       notification("n4"),
+			wantResult: pushFull,
+			want:       []string{"n1", "n2", "n3"},
+		},
+		{
+			name:       "room left, disconnect policy",
+			policy:     OverflowDisconnect,
+			queued:     []outbound{notification("n1")},
+			item:       response("r1"),
+			wantResult: pushed,
+			want:       []string{"n1", "r1"},
+		},
+		{
+			name:       "closed",
+			policy:     OverflowDropOldest,
+			closed:     true,
+			item:       response("r1"),
+			wantResult: pushClosed,
+		},
+		{
+			name:       "closed, disconnect policy",
+			policy:     OverflowDisconnect,
+			closed:     true,
+			item:       notification("n1"),
+			wantResult: pushClosed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOutbox(3, tt.policy)
+			for _, item := range tt.queued {
+				if _, result := o.push(item); result != pushed {
+					t.Fatalf("queueing %s: got %d", item.data, result)
+				}
+			}
+			if tt.closed {
+				o.close()
+			}
+
+			dropped, result := o.push(tt.item)
+			if dropped != tt.wantDropped || result != tt.wantResult {
+				t.Errorf("push returned (%d, %d), want (%d, %d)", dropped, result, tt.wantDropped, tt.wantResult)
+			}
+
+			var got []string
+			for _, item := range o.items {
+				got = append(got, string(item.data))
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("queue is %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("queue is %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestOutboxPop(t *testing.T) {
+	o := newOutbox(0, OverflowDropOldest)
+	if o.size != DefaultQueueSize {
+		t.Errorf("size is %d, want the default %d", o.size, DefaultQueueSize)
+	}
+
+	o.push(response("r1"))
+	o.push(notification("n1"))
+	for _, want := range []string{"r1", "n1"} {
+		item, ok := o.pop()
+		if !ok || string(item.data) != want {
+			t.Errorf("pop returned %s (%v), want %s", item.data, ok, want)
+		}
+	}
+
+	done := make(chan bool)
+	go func() {
+		_, ok := o.pop()
+		done <- ok
+	}()
+	o.close()
+	if ok := <-done; ok {
+		t.Error("pop returned an item after close")
+	}
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrWrongPin is returned when an app registers with a PIN that doesn't match the one of the proxy
+var ErrWrongPin = errors.New("wrong PIN")
+
+// RegisteredApp is an app that registered with the proxy
+type RegisteredApp struct {
+	UUID       []byte    `json:"uuid"`
+	DeviceName string    `json:"device_name"`
+	Registered time.Time `json:"registered"`
+}
+
+// Registrations is the list of apps that registered with the proxy with the right PIN, like the gateway keeps it.
+// Only registered apps can start a session. The list is stored in a file, when a path is given.
+type Registrations struct {
+	lock sync.Mutex
+	path string
+	pin  uint32
+	apps map[string]RegisteredApp
+}
+
+// NewRegistrations loads the registered apps from `path`, which doesn't have to exist yet.
+// An empty path keeps the list in memory only.
+func NewRegistrations(path string, pin uint32) (*Registrations, error) {
+	r := &Registrations{
+		path: path,
+		pin:  pin,
+		apps: make(map[string]RegisteredApp),
+	}
+	if path == "" {
+		return r, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("reading registered apps from %s", path))
+	}
+
+	var apps []RegisteredApp
+	err = json.Unmarshal(b, &apps)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("parsing registered apps from %s", path))
+	}
+	for _, app := range apps {
+		r.apps[hex.EncodeToString(app.UUID)] = app
+	}
+	return r, nil
+}
+
+// Register adds the app to the list, when the PIN is right. Registering again updates the device name.
+func (r *Registrations) Register(uuid []byte, deviceName string, pin uint32) error {
+	if pin != r.pin {
+		return ErrWrongPin
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	app, ok := r.apps[hex.EncodeToString(uuid)]
+	if !ok {
+		app = RegisteredApp{UUID: uuid, Registered: time.Now()}
+	}
+	app.DeviceName = deviceName
+	r.apps[hex.EncodeToString(uuid)] = app
+	return r.save()
+}
+
+// Deregister removes the app from the list
+func (r *Registrations) Deregister(uuid []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.apps[hex.EncodeToString(uuid)]; !ok {
+		return nil
+	}
+	delete(r.apps, hex.EncodeToString(uuid))
+	return r.save()
+}
+
+// Get returns the registration of an app
+func (r *Registrations) Get(uuid []byte) (RegisteredApp, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	app, ok := r.apps[hex.EncodeToString(uuid)]
+	return app, ok
+}
+
+// Registered returns true when the app is in the list
+func (r *Registrations) Registered(uuid []byte) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, ok := r.apps[hex.EncodeToString(uuid)]
+	return ok
+}
+
+// List returns the registered apps, in the order they registered
+func (r *Registrations) List() []RegisteredApp {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	apps := make([]RegisteredApp, 0, len(r.apps))
+	for _, app := range r.apps {
+		apps = append(apps, app)
+	}
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].Registered.Before(apps[j].Registered)
+	})
+	return apps
+}
+
+// writes the list to the file, must be called with the lock held
+func (r *Registrations) save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	apps := make([]RegisteredApp, 0, len(r.apps))
+	for _, app := range r.apps {
+		apps = append(apps, app)
+	}
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].Registered.Before(apps[j].Registered)
+	})
+	b, err := json.MarshalIndent(apps, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encoding registered apps")
+	}
+
+	// write to a temporary file first, so a crash doesn't leave half a list
+	tmp := r.path + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("writing registered apps to %s", tmp))
+	}
+	err = os.Rename(tmp, r.path)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("replacing %s", r.path))
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegistrations(t *testing.T) {
+	const pin = 4321
+	phone := bytes.Repeat([]byte{0x01}, 16)
+	tablet := bytes.Repeat([]byte{0x02}, 16)
+
+	type step struct {
+		deregister bool
+		uuid       []byte
+		deviceName string
+		pin        uint32
+		wantErr    error
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+		want  []string // the device names that are registered afterwards, in order
+	}{
+		{
+			name:  "right PIN",
+			steps: []step{{uuid: phone, deviceName: "phone", pin: pin}},
+			want:  []string{"phone"},
+		},
+		{
+			name:  "wrong PIN",
+			steps: []step{{uuid: phone, deviceName: "phone", pin: 1234, wantErr: ErrWrongPin}},
+		},
+		{
+			name: "in the order they registered",
+			steps: []step{
+				{uuid: tablet, deviceName: "tablet", pin: pin},
+				{uuid: phone, deviceName: "phone", pin: pin},
+			},
+			want: []string{"tablet", "phone"},
+		},
+		{
+			name: "registering again renames, and keeps the order",
+			steps: []step{
+				{uuid: phone, deviceName: "phone", pin: pin},
+				{uuid: tablet, deviceName: "tablet", pin: pin},
+				{uuid: phone, deviceName: "new phone", pin: pin},
+			},
+			want: []string{"new phone", "tablet"},
+		},
+		{
+			name: "registering again with the wrong PIN keeps the name",
+			steps: []step{
+				{uuid: phone, deviceName: "phone", pin: pin},
+				{uuid: phone, deviceName: "new phone", pin: 1234, wantErr: ErrWrongPin},
+			},
+			want: []string{"phone"},
+		},
+		{
+			name: "deregister",
+			steps: []step{
+				{uuid: phone, deviceName: "phone", pin: pin},
+				{uuid: tablet, deviceName: "tablet", pin: pin},
+				{deregister: true, uuid: phone},
+			},
+			want: []string{"tablet"},
+		},
+		{
+			name:  "deregister an unknown app",
+			steps: []step{{deregister: true, uuid: phone}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "registrations")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "apps.json")
+
+			r, err := NewRegistrations(path, pin)
+			if err != nil {
+				t.Fatalf("creating registrations: %v", err)
+			}
+			for i, s := range tt.steps {
+				if s.deregister {
+					err = r.Deregister(s.uuid)
+				} else {
+					err = r.Register(s.uuid, s.deviceName, s.pin)
+				}
+				if err != s.wantErr {
+					t.Fatalf("step %d: got error %v, want %v", i, err, s.wantErr)
+				}
+			}
+
+			// the list has to survive a restart
+			reloaded, err := NewRegistrations(path, pin)
+			if err != nil {
+				t.Fatalf("reloading registrations: %v", err)
+			}
+			for _, registrations := range []*Registrations{r, reloaded} {
+				var got []string
+				for _, app := range registrations.List() {
+					got = append(got, app.DeviceName)
+					if !registrations.Registered(app.UUID) {
+						t.Errorf("%s is listed, but not registered", app.DeviceName)
+					}
+				}
+				if len(got) != len(tt.want) {
+					t.Fatalf("registered are %v, want %v", got, tt.want)
+				}
+				for i := range got {
+					if got[i] != tt.want[i] {
+						t.Fatalf("registered are %v, want %v", got, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestNewRegistrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	invalid := filepath.Join(dir, "invalid.json")
+	err = ioutil.WriteFile(invalid, []byte("{"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{name: "in memory", path: ""},
+		{name: "file doesn't exist yet", path: filepath.Join(dir, "missing.json")},
+		{name: "invalid file", path: invalid, wantErr: true},
+		{name: "directory", path: dir, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRegistrations(tt.path, 0)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want an error: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(r.List()) != 0 {
+				t.Errorf("got %d registered apps, want none", len(r.List()))
+			}
+			if err := r.Register([]byte{0x01}, "phone", 0); err != nil {
+				t.Errorf("registering: %v", err)
+			}
+		})
+	}
+}
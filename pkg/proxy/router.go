@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
+)
+
+const (
+	// the references the proxy uses towards the gateway, above the ones the session uses for itself
+	firstProxyReference = 0x10000
+	lastProxyReference  = 0x7fffffff
+
+	// how long to wait for the response to a request from an app
+	routeTimeout = time.Minute
+)
+
+// the messages from the gateway that aren't a response, and go to all apps
+var notificationTypes = map[string]bool{
+	"GatewayNotificationType": true,
+	"CnNodeNotificationType":  true,
+	"CnRpdoNotificationType":  true,
+	"CnAlarmNotificationType": true,
+}
+
+func isNotification(message comfoconnect.Message) bool {
+	return notificationTypes[message.Operation.Type.String()]
+}
+
+// route is a request from an app that is waiting for a response
+type route struct {
+	app       *App
+	reference uint32 // the reference the app used
+	created   time.Time
+}
+
+// router rewrites the references of requests from apps into its own reference space, so requests from different apps
+// can't collide, and finds the app that a response from the gateway belongs to.
+type router struct {
+	lock   sync.Mutex
+	next   uint32
+	routes map[uint32]route
+}
+
+func newRouter() *router {
+	return &router{
+		next:   firstProxyReference,
+		routes: make(map[uint32]route),
+	}
+}
+
+// register replaces the reference of a message from `app` with a proxy reference, and remembers where it came from
+func (r *router) register(app *App, message *comfoconnect.Message) {
+	if message.Operation.Reference == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.expire()
+
+	reference := r.next
+	r.next++
+	if r.next > lastProxyReference {
+		r.next = firstProxyReference
+	}
+
+	r.routes[reference] = route{
+		app:       app,
+		reference: message.Operation.GetReference(),
+		created:   time.Now(),
+	}
+	message.Operation.Reference = &reference
+}
+
+// resolve finds the app that is waiting for a message from the gateway, and restores the reference that app used.
+// Returns false when no app is waiting for it.
+func (r *router) resolve(message *comfoconnect.Message) (*App, bool) {
+	if message.Operation.Reference == nil {
+		return nil, false
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	proxyReference := message.Operation.GetReference()
+	rt, ok := r.routes[proxyReference]
+	if !ok {
+		return nil, false
+	}
+	// the async response follows the confirm with the same reference
+	if message.Operation.Type.String() != "CnRmiAsyncConfirmType" {
+		delete(r.routes, proxyReference)
+	}
+
+	reference := rt.reference
+	message.Operation.Reference = &reference
+	return rt.app, true
+}
+
+// forget drops the routes of an app that went away
+func (r *router) forget(app *App) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for reference, rt := range r.routes {
+		if rt.app == app {
+			delete(r.routes, reference)
+		}
+	}
+}
+
+// drop routes that never got a response, must be called with the lock held
+func (r *router) expire() {
+	for reference, rt := range r.routes {
+		if time.Since(rt.created) > routeTimeout {
+			logrus.WithFields(logrus.Fields{
+				"module": "proxy",
+				"object": "router",
+				"method": "expire",
+			}).Warnf("no response for reference %d of app %s", rt.reference, rt.app.conn.RemoteAddr())
+			delete(r.routes, reference)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hsmade/comfoconnectbridge/pkg/comfoconnect"
+	"github.com/hsmade/comfoconnectbridge/proto"
+)
+
+// returns a message of type `operationType` with `reference`, or without a reference when it's 0
+func testMessage(operationType proto.GatewayOperation_OperationType, reference uint32) *comfoconnect.Message {
+	message := &comfoconnect.Message{Operation: proto.GatewayOperation{Type: operationType.Enum()}}
+	if reference != 0 {
+		message.Operation.Reference = &reference
+	}
+	return message
+}
+
+// returns an app with a connection that isn't used, the router only logs its address
+func testApp(t *testing.T) *App {
+	conn, _ := net.Pipe()
+	return &App{conn: conn}
+}
+
+func TestRouter(t *testing.T) {
+	type step struct {
+		app      int // index of the app, -1 for a message from the gateway
+		message  *comfoconnect.Message
+		want     uint32 // the reference after register or resolve
+		wantApp  int    // for resolve, the index of the app it's routed to, -1 for none
+		wantKept bool   // for resolve, whether the route is still there afterwards
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "request and confirm",
+			steps: []step{
+				{app: 0, message: testMessage(proto.GatewayOperation_CnRmiRequestType, 7), want: firstProxyReference},
+				{app: -1, message: testMessage(proto.GatewayOperation_CnRmiResponseType, firstProxyReference), want: 7, wantApp: 0},
+			},
+		},
+		{
+			name: "same reference from two apps",
+			steps: []step{
+				{app: 0, message: testMessage(proto.GatewayOperation_CnRmiRequestType, 7), want: firstProxyReference},
+				{app: 1, message: testMessage(proto.GatewayOperation_CnRmiRequestType, 7), want: firstProxyReference + 1},
+				{app: -1, message: testMessage(proto.GatewayOperation_CnRmiResponseType, firstProxyReference+1), want: 7, wantApp: 1},
+				{app: -1, message: testMessage(proto.GatewayOperation_CnRmiResponseType, firstProxyReference), want: 7, wantApp: 0},
+			},
+		},
+		{
+			name: "async confirm keeps the route for the response",
+			steps: []step{
+				{app: 0, message: testMessage(proto.GatewayOperation_CnRmiAsyncRequestType, 3), want: firstProxyReference},
+				{app: -1, message: testMessage(proto.GatewayOperation_CnRmiAsyncConfirmType, firstProxyReference), want: 3, wantApp: 0, wantKept: true},
+				{app: -1, message: testMessage(proto.GatewayOperation_CnRmiAsyncResponseType, firstProxyReference), want: 3, wantApp: 0},
+			},
+		},
+		{
+			name: "unknown reference",
+			steps: []step{
+				{app: -1, message: testMessage(proto.GatewayOperation_CnRmiResponseType, firstProxyReference), want: firstProxyReference, wantApp: -1},
+			},
+		},
+		{
+			name: "second confirm for the same reference",
+			steps: []step{
+				{app: 0, message: testMessage(proto.GatewayOperation_CnTimeRequestType, 9), want: firstProxyReference},
+				{app: -1, message: testMessage(proto.GatewayOperation_CnTimeConfirmType, firstProxyReference), want: 9, wantApp: 0},
+				{app: -1, message: testMessage(proto.GatewayOperation_CnTimeConfirmType, firstProxyReference), want: firstProxyReference, wantApp: -1},
+			},
+		},
+		{
+			name: "without reference",
+			steps: []step{
+				{app: 0, message: testMessage(proto.GatewayOperation_CnRpdoRequestType, 0)},
+				{app: -1, message: testMessage(proto.GatewayOperation_CnRpdoConfirmType, 0), wantApp: -1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRouter()
+			apps := []*App{testApp(t), testApp(t)}
+			for i, s := range tt.steps {
+				if s.app >= 0 {
+					r.register(apps[s.app], s.message)
+				} else {
+					proxyReference := s.message.Operation.GetReference()
+					app, ok := r.resolve(s.message)
+					if s.wantApp < 0 {
+						if ok {
+							t.Errorf("step %d: resolved to %p, want no app", i, app)
+						}
+					} else if !ok || app != apps[s.wantApp] {
+						t.Errorf("step %d: resolved to %p (%v), want app %d", i, app, ok, s.wantApp)
+					}
+					if _, kept := r.routes[proxyReference]; kept != s.wantKept {
+						t.Errorf("step %d: route kept is %v, want %v", i, kept, s.wantKept)
+					}
+				}
+				if got := s.message.Operation.GetReference(); got != s.want {
+					t.Errorf("step %d: reference is %d, want %d", i, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRouterWrapsAround(t *testing.T) {
+	r := newRouter()
+	r.next = lastProxyReference
+	app := testApp(t)
+
+	r.register(app, testMessage(proto.GatewayOperation_CnRmiRequestType, 1))
+	message := testMessage(proto.GatewayOperation_CnRmiRequestType, 2)
+	r.register(app, message)
+	if got := message.Operation.GetReference(); got != firstProxyReference {
+		t.Errorf("reference after the last one is %d, want %d", got, firstProxyReference)
+	}
+}
+
+func TestRouterForget(t *testing.T) {
+	r := newRouter()
+	gone, staying := testApp(t), testApp(t)
+	r.register(gone, testMessage(proto.GatewayOperation_CnRmiRequestType, 1))
+	r.register(staying, testMessage(proto.GatewayOperation_CnRmiRequestType, 1))
+	r.register(gone, testMessage(proto.GatewayOperation_CnRmiRequestType, 2))
+
+	r.forget(gone)
+
+	if len(r.routes) != 1 {
+		t.Fatalf("got %d routes, want 1", len(r.routes))
+	}
+	if app, ok := r.resolve(testMessage(proto.GatewayOperation_CnRmiResponseType, firstProxyReference+1)); !ok || app != staying {
+		t.Errorf("route of the other app resolved to %p (%v)", app, ok)
+	}
+}
+
+func TestRouterExpire(t *testing.T) {
+	r := newRouter()
+	app := testApp(t)
+	r.register(app, testMessage(proto.GatewayOperation_CnRmiRequestType, 1))
+	r.register(app, testMessage(proto.GatewayOperation_CnRmiRequestType, 2))
+
+	old := r.routes[firstProxyReference]
+	old.created = time.Now().Add(-routeTimeout - time.Second)
+	r.routes[firstProxyReference] = old
+
+	// expiring happens on register
+	r.register(app, testMessage(proto.GatewayOperation_CnRmiRequestType, 3))
+
+	if _, ok := r.routes[firstProxyReference]; ok {
+		t.Error("route older than the timeout wasn't expired")
+	}
+	if len(r.routes) != 2 {
+		t.Errorf("got %d routes, want 2", len(r.routes))
+	}
+}